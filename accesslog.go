@@ -0,0 +1,122 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// accessLogBuffer is the number of access log
+// entries that can be queued for writing before
+// new entries are dropped
+const accessLogBuffer = 1024
+
+// accessLogEntry describes a single
+// connection delivered by the listener
+type accessLogEntry struct {
+	time       time.Time
+	id         uint64
+	remoteAddr net.Addr
+	proto      string
+	listener   string
+	version    uint16
+	label      string
+}
+
+// accessLog writes entries to the configured
+// writer from its own go routine so that slow
+// writes never hold up connection delivery
+type accessLog struct {
+	writer  io.Writer
+	entries chan accessLogEntry
+	closed  bool
+	lock    sync.RWMutex
+}
+
+// newAccessLog creates an access log for
+// the writer and starts the go routine
+// that writes queued entries
+func newAccessLog(writer io.Writer) *accessLog {
+	log := &accessLog{
+		writer:  writer,
+		entries: make(chan accessLogEntry, accessLogBuffer),
+	}
+
+	go log.write()
+	return log
+}
+
+// log queues an entry to be written, if the
+// queue is full the entry is dropped rather than
+// blocking the caller
+func (log *accessLog) log(entry accessLogEntry) {
+	log.lock.RLock()
+	defer log.lock.RUnlock()
+
+	if log.closed {
+		return
+	}
+
+	select {
+	case log.entries <- entry:
+	default:
+	}
+}
+
+// write formats and writes queued entries
+// until the access log is closed
+func (log *accessLog) write() {
+	for entry := range log.entries {
+		var label string
+		if entry.label != "" {
+			label = fmt.Sprintf(" label=%q", entry.label)
+		}
+
+		fmt.Fprintf(log.writer, "%s %s id=%d proto=%q listener=%s version=%s%s\n",
+			entry.time.Format(time.RFC3339),
+			entry.remoteAddr,
+			entry.id,
+			entry.proto,
+			entry.listener,
+			versionName(entry.version),
+			label,
+		)
+	}
+}
+
+// close stops the access log from accepting
+// new entries, entries already queued are
+// still written
+func (log *accessLog) close() {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	if !log.closed {
+		log.closed = true
+		close(log.entries)
+	}
+}
+
+// versionName returns a readable name
+// for a TLS version number
+func versionName(version uint16) string {
+	switch version {
+	case 0:
+		return "none"
+	case tls.VersionSSL30:
+		return "SSL3.0"
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
@@ -0,0 +1,93 @@
+package tlsprotocol
+
+import (
+	"bytes"
+	"crypto/tls"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sync"
+)
+
+// lockedBuffer is a bytes.Buffer that is safe
+// to write to from the access log go routine
+type lockedBuffer struct {
+	buffer bytes.Buffer
+	lock   sync.Mutex
+}
+
+func (buffer *lockedBuffer) Write(b []byte) (int, error) {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	return buffer.buffer.Write(b)
+}
+
+func (buffer *lockedBuffer) String() string {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	return buffer.buffer.String()
+}
+
+var _ = Describe("Access log", func() {
+	output := &lockedBuffer{}
+
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:  "127.0.0.1:6085",
+		AccessLog: output,
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should write a line for each delivered connection", func() {
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6085", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := h2Listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		Eventually(output.String).Should(ContainSubstring(conn.LocalAddr().String() + ` id=1 proto="h2" listener=h2 version=TLS1.3`))
+	})
+})
+
+var _ = Describe("Connection labels", func() {
+	output := &lockedBuffer{}
+
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:  "127.0.0.1:6111",
+		AccessLog: output,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		Labeler: func(hello *tls.ClientHelloInfo) string {
+			return "client:" + hello.ServerName
+		},
+	}
+
+	It("Should label connections from their ClientHello", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6111", &tls.Config{InsecureSkipVerify: true, ServerName: "app.example"})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		tracked, _ := ConnFrom(serverConn)
+		Expect(tracked.Label()).To(Equal("client:app.example"))
+		Expect(listener.Stats().Labels).To(Equal(map[string]uint64{"client:app.example": 1}))
+		Eventually(output.String).Should(ContainSubstring(`version=TLS1.3 label="client:app.example"`))
+	})
+})
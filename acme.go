@@ -0,0 +1,56 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// acmeTLSProtocol is the ALPN Protocol of
+// ACME TLS-ALPN-01 challenge handshakes (RFC 8737)
+const acmeTLSProtocol = "acme-tls/1"
+
+// ACMEChallenge serves ACME TLS-ALPN-01 challenges on the
+// listener's port, it adds the "acme-tls/1" protocol to the
+// TLS configuration and answers challenge handshakes with
+// the certificate `certFunc` returns for the SNI server name.
+//
+// A challenge is complete once the handshake is, so these
+// connections are closed straight after being delivered.
+// If `certFunc` returns nil the handshake is aborted.
+func (listener *Listener) ACMEChallenge(certFunc func(sni string) *tls.Certificate) error {
+	if len(listener.workers) > 0 {
+		return fmt.Errorf("ACME challenge must be created before starting listener")
+	}
+
+	if !listener.protocolConfigured(acmeTLSProtocol) {
+		err := listener.updateConfig(func(config *tls.Config) error {
+			config.NextProtos = append(config.NextProtos[:len(config.NextProtos):len(config.NextProtos)], acmeTLSProtocol)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	protocol, err := listener.Protocol(acmeTLSProtocol)
+	if err != nil {
+		return err
+	}
+
+	protocol.(*Protocol).getCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cert := certFunc(hello.ServerName); cert != nil {
+			return cert, nil
+		}
+
+		return nil, fmt.Errorf("no ACME challenge certificate for server name: %s", hello.ServerName)
+	}
+
+	go func(channel chan net.Conn) {
+		for conn := range channel {
+			conn.Close()
+		}
+	}(protocol.(*Protocol).channel)
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package tlsprotocol
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// bufferedFlushDelay is how long writes to a
+// BufferedConn are held before being flushed if
+// the buffer hasn't filled up in the meantime
+const bufferedFlushDelay = time.Millisecond
+
+// BufferedConn is the connection delivered when the
+// listener's BufferedWrites is set, it coalesces small
+// writes into fewer writes to the TLS connection which
+// are flushed once the buffer is full, after a short
+// delay, on Flush() or when the connection is closed
+type BufferedConn struct {
+	net.Conn
+
+	writer *bufio.Writer
+	timer  *time.Timer
+	lock   sync.Mutex
+}
+
+// newBufferedConn wraps the delivered connection
+// with a write buffer of `size` bytes
+func newBufferedConn(conn net.Conn, size int) *BufferedConn {
+	return &BufferedConn{
+		Conn:   conn,
+		writer: bufio.NewWriterSize(conn, size),
+	}
+}
+
+// Write buffers the bytes, writing them to the
+// connection when the buffer fills up and arranging
+// for anything left buffered to be flushed shortly
+func (conn *BufferedConn) Write(b []byte) (int, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	n, err := conn.writer.Write(b)
+	if conn.writer.Buffered() > 0 && conn.timer == nil {
+		conn.timer = time.AfterFunc(bufferedFlushDelay, func() {
+			conn.Flush()
+		})
+	}
+
+	return n, err
+}
+
+// Flush writes any buffered bytes to the connection,
+// once a write has failed every call returns its error
+func (conn *BufferedConn) Flush() error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if conn.timer != nil {
+		conn.timer.Stop()
+		conn.timer = nil
+	}
+
+	return conn.writer.Flush()
+}
+
+// Close flushes any buffered bytes
+// and then closes the connection
+func (conn *BufferedConn) Close() error {
+	conn.Flush()
+	return conn.Conn.Close()
+}
+
+// NetConn returns the buffered connection
+func (conn *BufferedConn) NetConn() net.Conn {
+	return conn.Conn
+}
@@ -0,0 +1,54 @@
+package tlsprotocol
+
+import (
+	"time"
+)
+
+// clock is the source of time for the listener's
+// timing features so they can be tested without
+// waiting on the wall clock, socket deadlines are
+// always set from the wall clock as the runtime
+// compares them against it
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// clockTimer is a timer started by a clock's
+// AfterFunc, it's implemented by *time.Timer
+type clockTimer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// wallClock is the clock used
+// when a listener has none set
+type wallClock struct{}
+
+// Now returns the current time
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for the duration to
+// elapse and then sends the time
+func (wallClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// AfterFunc waits for the duration to elapse
+// and then calls f in its own go routine
+func (wallClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// getClock returns the listener's clock,
+// defaulting to the wall clock
+func (listener *Listener) getClock() clock {
+	if listener.clock == nil {
+		return wallClock{}
+	}
+
+	return listener.clock
+}
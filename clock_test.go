@@ -0,0 +1,155 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sync"
+	"time"
+)
+
+// fakeClock is a clock that only moves when read,
+// each call to Now() advances it by `step` and
+// After() advances it by the duration waited for.
+// The functions of AfterFunc() are only called
+// when Advance() moves the clock past them
+type fakeClock struct {
+	now    time.Time
+	step   time.Duration
+	timers []*fakeTimer
+	lock   sync.Mutex
+}
+
+// fakeTimer is a timer started by
+// the AfterFunc() of a fakeClock
+type fakeTimer struct {
+	clock  *fakeClock
+	at     time.Time
+	f      func()
+	active bool
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	now := clock.now
+	clock.now = clock.now.Add(clock.step)
+	return now
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.now = clock.now.Add(d)
+
+	after := make(chan time.Time, 1)
+	after <- clock.now
+	return after
+}
+
+func (clock *fakeClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	timer := &fakeTimer{clock: clock, at: clock.now.Add(d), f: f, active: true}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward by the duration,
+// calling the functions of the timers that are due
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	clock.now = clock.now.Add(d)
+
+	var due []func()
+	for _, timer := range clock.timers {
+		if timer.active && !timer.at.After(clock.now) {
+			timer.active = false
+			due = append(due, timer.f)
+		}
+	}
+	clock.lock.Unlock()
+
+	for i := range due {
+		due[i]()
+	}
+}
+
+func (timer *fakeTimer) Stop() bool {
+	timer.clock.lock.Lock()
+	defer timer.clock.lock.Unlock()
+
+	active := timer.active
+	timer.active = false
+	return active
+}
+
+func (timer *fakeTimer) Reset(d time.Duration) bool {
+	timer.clock.lock.Lock()
+	defer timer.clock.lock.Unlock()
+
+	active := timer.active
+	timer.active = true
+	timer.at = timer.clock.now.Add(d)
+	return active
+}
+
+// skewedClock is a clock running `offset`
+// from the wall clock, its waits and timers
+// take as long as they do on the wall clock
+type skewedClock struct {
+	offset time.Duration
+}
+
+func (clock skewedClock) Now() time.Time {
+	return time.Now().Add(clock.offset)
+}
+
+func (clock skewedClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (clock skewedClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return time.AfterFunc(d, f)
+}
+
+var _ = Describe("Clock", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6107",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		clock: &fakeClock{step: 2 * time.Second},
+	}
+
+	It("Should time handshakes with the listener's clock", func() {
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6107", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		Expect(listener.Stats().HandshakeDurations).To(Equal([5]uint64{0, 0, 0, 0, 1}))
+	})
+
+	It("Should time graceful stops with the listener's clock", func() {
+		conn, err := tls.Dial("tcp", "127.0.0.1:6107", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		Eventually(func() int { return len(listener.defaultChannel) }).Should(Equal(1))
+
+		stopped := make(chan int, 1)
+		go func() { stopped <- listener.GracefulStop(time.Hour) }()
+
+		Eventually(stopped).Should(Receive(Equal(1)))
+	})
+})
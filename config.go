@@ -0,0 +1,465 @@
+package tlsprotocol
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// serverConfig returns the TLS configuration
+// that should be used for a new handshake
+func (listener *Listener) serverConfig() *tls.Config {
+	listener.configLock.RLock()
+	defer listener.configLock.RUnlock()
+
+	if listener.handshakeConfig == nil {
+		return listener.TLSConfig
+	}
+
+	return listener.handshakeConfig
+}
+
+// validateConfig checks the TLS configuration can
+// complete a handshake, it is called by Start() so
+// a missing configuration fails before listening
+// instead of with every handshake
+func (listener *Listener) validateConfig() error {
+	listener.configLock.RLock()
+	defer listener.configLock.RUnlock()
+
+	config := listener.config
+	if config == nil {
+		config = listener.TLSConfig
+	}
+
+	if config == nil {
+		return fmt.Errorf("listener has no TLS configuration")
+	}
+
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil && listener.DefaultCertificate == nil {
+		return fmt.Errorf("TLS configuration has no certificates, set Certificates, GetCertificate or GetConfigForClient")
+	}
+
+	return nil
+}
+
+// prepareConfig builds the handshake configuration
+// from the current TLS configuration, it is called
+// by Start() before any worker is accepting
+func (listener *Listener) prepareConfig() {
+	listener.configLock.Lock()
+	defer listener.configLock.Unlock()
+
+	current := listener.config
+	if current == nil {
+		current = listener.TLSConfig
+	}
+
+	if current != nil {
+		listener.setConfig(current)
+	}
+}
+
+// updateConfig applies the update to a copy of the
+// current TLS configuration and then swaps the copy in,
+// a tls.Config must not be modified once it has been
+// used for a handshake so it is replaced instead
+func (listener *Listener) updateConfig(update func(config *tls.Config) error) error {
+	listener.configLock.Lock()
+	defer listener.configLock.Unlock()
+
+	current := listener.config
+	if current == nil {
+		current = listener.TLSConfig
+	}
+
+	if current == nil {
+		return fmt.Errorf("listener has no TLS configuration")
+	}
+
+	config := current.Clone()
+	if err := update(config); err != nil {
+		return err
+	}
+
+	listener.setConfig(config)
+	return nil
+}
+
+// setConfig stores the TLS configuration and derives
+// the handshake configuration from it, which hooks
+// `GetConfigForClient` so the listener can inspect
+// the ClientHello before deferring to the original
+// callback, configLock must be held by the caller
+func (listener *Listener) setConfig(config *tls.Config) {
+	next := config.GetConfigForClient
+
+	handshakeConfig := config.Clone()
+	handshakeConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return listener.configForClient(hello, next)
+	}
+
+	if listener.DisableDynamicRecordSizing {
+		handshakeConfig.DynamicRecordSizingDisabled = true
+	}
+
+	if listener.DefaultCertificate != nil && (config.GetCertificate != nil || len(config.Certificates) == 0) {
+		handshakeConfig.GetCertificate = defaultCertificate(config.GetCertificate, listener.DefaultCertificate)
+	}
+
+	if keys := listener.sessionTicketKeys(handshakeConfig); keys != nil {
+		handshakeConfig.SetSessionTicketKeys(keys)
+	}
+
+	listener.config = config
+	listener.handshakeConfig = handshakeConfig
+	listener.protocolConfigs = make(map[string]*tls.Config)
+
+	listener.channelsLock.RLock()
+	defer listener.channelsLock.RUnlock()
+
+	for proto, protocol := range listener.channels {
+		if protocol.clientAuth == nil && protocol.getCertificate == nil && !protocol.rejectEarlyData && !listener.EarlyRouting {
+			continue
+		}
+
+		protocolConfig := handshakeConfig.Clone()
+		if listener.EarlyRouting {
+			protocolConfig.NextProtos = []string{proto}
+		}
+
+		if protocol.clientAuth != nil {
+			protocolConfig.ClientAuth = *protocol.clientAuth
+		}
+
+		if protocol.getCertificate != nil {
+			protocolConfig.Certificates = nil
+			protocolConfig.GetCertificate = protocol.getCertificate
+		}
+
+		if protocol.rejectEarlyData {
+			protocolConfig.WrapSession = withoutEarlyData(handshakeConfig)
+		}
+
+		listener.protocolConfigs[proto] = protocolConfig
+	}
+}
+
+// sessionTicketKeys returns the session ticket keys
+// for the handshake configuration, a tls.Config without
+// keys of its own generates them the first time it issues
+// a ticket so every configuration swap would otherwise
+// invalidate the tickets already issued. The keys are
+// generated once per listener unless they are set with
+// SetSessionTicketKeys, nil is returned when the
+// configuration sets `SessionTicketKey` or the keys
+// couldn't be generated, configLock must be held by
+// the caller
+func (listener *Listener) sessionTicketKeys(config *tls.Config) [][32]byte {
+	if config.SessionTicketsDisabled || config.SessionTicketKey != [32]byte{} {
+		return nil
+	}
+
+	if listener.ticketKeys == nil {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return nil
+		}
+
+		listener.ticketKeys = [][32]byte{key}
+	}
+
+	return listener.ticketKeys
+}
+
+// withoutEarlyData returns a `WrapSession` callback
+// that clears the early data flag of the session before
+// passing it to the configuration's own callback, or
+// encrypting it with the configuration's ticket keys.
+// It must be the configuration handed to tls.Server()
+// as resumed tickets are decrypted with its keys rather
+// than those of the one `GetConfigForClient` returned
+func withoutEarlyData(config *tls.Config) func(tls.ConnectionState, *tls.SessionState) ([]byte, error) {
+	wrap := config.WrapSession
+	return func(state tls.ConnectionState, session *tls.SessionState) ([]byte, error) {
+		session.EarlyData = false
+		if wrap != nil {
+			return wrap(state, session)
+		}
+
+		return config.EncryptTicket(state, session)
+	}
+}
+
+// defaultCertificate wraps the `GetCertificate` callback
+// so that the default certificate is used when the callback
+// has no match, including when it returns an error
+func defaultCertificate(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), fallback *tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if getCertificate != nil {
+			if cert, err := getCertificate(hello); cert != nil && err == nil {
+				return cert, nil
+			}
+		}
+
+		return fallback, nil
+	}
+}
+
+// protocolConfig returns the handshake configuration
+// specific to the ALPN Protocol, if the Protocol
+// listener doesn't need one nil is returned
+func (listener *Listener) protocolConfig(proto string) *tls.Config {
+	listener.configLock.RLock()
+	defer listener.configLock.RUnlock()
+	return listener.protocolConfigs[proto]
+}
+
+// selectedProtocol returns the ALPN Protocol the server
+// will negotiate for the protocols offered by the client
+func (listener *Listener) selectedProtocol(offered []string) (string, bool) {
+	listener.configLock.RLock()
+	defer listener.configLock.RUnlock()
+
+	config := listener.handshakeConfig
+	if config == nil {
+		config = listener.TLSConfig
+	}
+
+	if config == nil {
+		return "", false
+	}
+
+	return selectProtocol(config.NextProtos, offered)
+}
+
+// supportsVersions reports if any of the TLS versions
+// offered by the client is at least the MinVersion of
+// the handshake configuration
+func (listener *Listener) supportsVersions(offered []uint16) bool {
+	if len(offered) == 0 {
+		return true
+	}
+
+	listener.configLock.RLock()
+	defer listener.configLock.RUnlock()
+
+	config := listener.handshakeConfig
+	if config == nil {
+		config = listener.TLSConfig
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if config != nil && config.MinVersion != 0 {
+		minVersion = config.MinVersion
+	}
+
+	for _, version := range offered {
+		if version >= minVersion {
+			return true
+		}
+	}
+
+	return false
+}
+
+// protocolFor returns the Protocol listener that
+// receives the connections of the ALPN Protocol
+func (listener *Listener) protocolFor(proto string) (*Protocol, bool) {
+	listener.channelsLock.RLock()
+	defer listener.channelsLock.RUnlock()
+	return listener.lookupProtocol(proto)
+}
+
+// selectProtocol returns the ALPN Protocol that will be
+// negotiated for the offered protocols, crypto/tls picks
+// the first of the server's protocols the client offers
+func selectProtocol(serverProtos, offered []string) (string, bool) {
+	for _, serverProto := range serverProtos {
+		for _, offeredProto := range offered {
+			if serverProto == offeredProto {
+				return serverProto, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// configForClient is called with the ClientHello of
+// every handshake, returning an error aborts the handshake
+// and a nil config continues with the handshake configuration
+func (listener *Listener) configForClient(hello *tls.ClientHelloInfo, next func(*tls.ClientHelloInfo) (*tls.Config, error)) (*tls.Config, error) {
+	if watched, ok := hello.Conn.(*helloConn); ok {
+		captured := watched.helloReceived()
+		if listener.OnClientHelloBytes != nil {
+			listener.OnClientHelloBytes(watched.RemoteAddr(), captured)
+		}
+	}
+
+	if listener.Labeler != nil {
+		if tracked, ok := ConnFrom(hello.Conn); ok {
+			tracked.label = listener.Labeler(hello)
+		}
+	}
+
+	if listener.InspectClientHello != nil {
+		listener.InspectClientHello(hello)
+	}
+
+	if listener.OnUnsupportedVersion != nil && !listener.supportsVersions(hello.SupportedVersions) {
+		listener.OnUnsupportedVersion(hello)
+	}
+
+	if listener.AllowServerName != nil && !listener.AllowServerName(hello.ServerName) {
+		return nil, fmt.Errorf("server name not allowed: %s", hello.ServerName)
+	}
+
+	proto, selected := listener.selectedProtocol(hello.SupportedProtos)
+	if protocol, ok := listener.protocolFor(proto); selected && ok && protocol.handshakeTimeout > 0 {
+		if err := hello.Conn.SetDeadline(time.Now().Add(protocol.handshakeTimeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	if next != nil {
+		config, err := next(hello)
+		if config != nil || err != nil {
+			return config, err
+		}
+	}
+
+	if !selected {
+		return nil, nil
+	}
+
+	protocolConfig := listener.protocolConfig(proto)
+	if listener.EarlyRouting && protocolConfig != nil {
+		if tracked, ok := ConnFrom(hello.Conn); ok {
+			tracked.route = proto
+		}
+	}
+
+	return protocolConfig, nil
+}
+
+// SetOCSPStaple replaces the stapled OCSP response
+// of the certificate at `certIndex` in the TLS
+// configuration's `Certificates`, handshakes started
+// after the call will staple the new response
+func (listener *Listener) SetOCSPStaple(certIndex int, staple []byte) error {
+	return listener.updateConfig(func(config *tls.Config) error {
+		if certIndex < 0 || certIndex >= len(config.Certificates) {
+			return fmt.Errorf("certificate index out of range: %d", certIndex)
+		}
+
+		certificates := make([]tls.Certificate, len(config.Certificates))
+		copy(certificates, config.Certificates)
+		certificates[certIndex].OCSPStaple = staple
+		config.Certificates = certificates
+
+		return nil
+	})
+}
+
+// SetSessionTicketKeys replaces the keys the listener
+// encrypts and decrypts session tickets with, the first
+// key encrypts new tickets and all of them are tried
+// when decrypting so keys can be rotated without
+// invalidating the tickets already issued.
+//
+// The listener sets its keys on every configuration it
+// hands to handshakes so tickets stay valid when the
+// configuration is swapped, keys set on the TLSConfig
+// with `tls.Config.SetSessionTicketKeys` are replaced
+// and must be rotated with this method instead
+func (listener *Listener) SetSessionTicketKeys(keys [][32]byte) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("at least one session ticket key is required")
+	}
+
+	listener.configLock.Lock()
+	defer listener.configLock.Unlock()
+
+	listener.ticketKeys = append([][32]byte(nil), keys...)
+
+	current := listener.config
+	if current == nil {
+		current = listener.TLSConfig
+	}
+
+	if current != nil {
+		listener.setConfig(current)
+	}
+
+	return nil
+}
+
+// SetGetCertificate replaces the `GetCertificate`
+// callback of the TLS configuration so certificates
+// can be selected by the ClientHello (i.e. by SNI).
+//
+// It is safe to call while the listener is running,
+// handshakes already in progress keep the callback
+// they started with and new handshakes use the new one
+func (listener *Listener) SetGetCertificate(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
+	return listener.updateConfig(func(config *tls.Config) error {
+		config.GetCertificate = getCertificate
+		return nil
+	})
+}
+
+// SetProtocolPreference reorders the `NextProtos` of the
+// TLS configuration, the server negotiates the first of its
+// protocols a client offers so the order decides which wins
+// when a client offers several. The order must contain each
+// of the configuration's protocols exactly once so no
+// Protocol listener loses its traffic.
+//
+// It is safe to call while the listener is running,
+// handshakes started after the call use the new order
+func (listener *Listener) SetProtocolPreference(order []string) error {
+	return listener.updateConfig(func(config *tls.Config) error {
+		if len(order) != len(config.NextProtos) {
+			return fmt.Errorf("protocol preference must list the %d configured protocols: %v", len(config.NextProtos), order)
+		}
+
+		listed := make(map[string]bool, len(order))
+		for _, proto := range order {
+			if listed[proto] {
+				return fmt.Errorf("protocol listed more than once: %s", proto)
+			}
+
+			listed[proto] = true
+		}
+
+		for _, proto := range config.NextProtos {
+			if !listed[proto] {
+				return fmt.Errorf("protocol preference is missing configured protocol: %s", proto)
+			}
+		}
+
+		config.NextProtos = append([]string(nil), order...)
+		return nil
+	})
+}
+
+// ReloadCertFromFiles loads the PEM encoded key pair
+// from the files and swaps it in as the certificate of
+// the TLS configuration, replacing its `Certificates`.
+//
+// It is safe to call while the listener is running,
+// connections already established are untouched and
+// new handshakes present the reloaded certificate
+func (listener *Listener) ReloadCertFromFiles(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+
+	return listener.updateConfig(func(config *tls.Config) error {
+		config.Certificates = []tls.Certificate{cert}
+		return nil
+	})
+}
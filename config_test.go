@@ -0,0 +1,667 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+	"time"
+)
+
+var _ = Describe("Config", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6082",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Shouldn't allow an OCSP staple for a certificate that doesn't exist", func() {
+		err := listener.SetOCSPStaple(1, []byte("staple"))
+
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal("certificate index out of range: 1"))
+	})
+
+	It("Should staple the updated OCSP response to new handshakes", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		Expect(listener.SetOCSPStaple(0, []byte("staple"))).To(BeNil())
+		Expect(listener.TLSConfig.Certificates[0].OCSPStaple).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6082", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		Expect(conn.ConnectionState().OCSPResponse).To(Equal([]byte("staple")))
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+
+	It("Should resume sessions issued before the OCSP staple was updated", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		clientConfig := &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		}
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6082", clientConfig)
+		Expect(err).To(BeNil())
+		conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		Expect(listener.SetOCSPStaple(0, []byte("renewed"))).To(BeNil())
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:6082", clientConfig)
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		Expect(conn.ConnectionState().DidResume).To(BeTrue())
+
+		serverConn, err = listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+
+	It("Should resume sessions across rotated session ticket keys", func() {
+		first, second := [32]byte{1}, [32]byte{2}
+		Expect(listener.SetSessionTicketKeys(nil)).ToNot(BeNil())
+		Expect(listener.SetSessionTicketKeys([][32]byte{first})).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		clientConfig := &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		}
+
+		dial := func() bool {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6082", clientConfig)
+			Expect(err).To(BeNil())
+			defer conn.Close()
+
+			serverConn, err := listener.Accept()
+			Expect(err).To(BeNil())
+			serverConn.Close()
+
+			return conn.ConnectionState().DidResume
+		}
+
+		Expect(dial()).To(BeFalse())
+
+		Expect(listener.SetSessionTicketKeys([][32]byte{second, first})).To(BeNil())
+		Expect(dial()).To(BeTrue())
+
+		Expect(listener.SetSessionTicketKeys([][32]byte{{3}})).To(BeNil())
+		Expect(dial()).To(BeFalse())
+	})
+})
+
+var _ = Describe("Server name filtering", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6084",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		AllowServerName: func(name string) bool {
+			return name == "allowed.example"
+		},
+	}
+
+	It("Should abort handshakes for server names that aren't allowed", func() {
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6084", &tls.Config{InsecureSkipVerify: true, ServerName: "blocked.example"})
+		Expect(err).ToNot(BeNil())
+		Expect(conn).To(BeNil())
+		Expect(len(listener.defaultChannel)).To(Equal(0))
+	})
+
+	It("Should deliver connections for allowed server names", func() {
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6084", &tls.Config{InsecureSkipVerify: true, ServerName: "allowed.example"})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Config validation", func() {
+	It("Shouldn't start without a TLS configuration", func() {
+		listener := &Listener{BindAddr: "127.0.0.1:6096"}
+		Expect(listener.Start()).To(MatchError("listener has no TLS configuration"))
+	})
+
+	It("Shouldn't start without a way to find a certificate", func() {
+		listener := &Listener{BindAddr: "127.0.0.1:6096", TLSConfig: &tls.Config{NextProtos: []string{"h2"}}}
+		Expect(listener.Start()).To(MatchError("TLS configuration has no certificates, set Certificates, GetCertificate or GetConfigForClient"))
+	})
+})
+
+var _ = Describe("ClientHello inspection", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	hellos := make(chan tls.ClientHelloInfo, 1)
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6099",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+		AllowServerName: func(name string) bool {
+			return false
+		},
+		InspectClientHello: func(hello *tls.ClientHelloInfo) {
+			hellos <- tls.ClientHelloInfo{ServerName: hello.ServerName, SupportedProtos: hello.SupportedProtos}
+		},
+	}
+
+	It("Should inspect the ClientHello of handshakes that fail", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6099", &tls.Config{InsecureSkipVerify: true, ServerName: "inspected.example", NextProtos: []string{"h2", "http/1.1"}})
+		if err == nil {
+			conn.Close()
+		}
+		Expect(err).ToNot(BeNil())
+
+		var hello tls.ClientHelloInfo
+		Eventually(hellos).Should(Receive(&hello))
+		Expect(hello.ServerName).To(Equal("inspected.example"))
+		Expect(hello.SupportedProtos).To(Equal([]string{"h2", "http/1.1"}))
+	})
+})
+
+var _ = Describe("ClientHello capture", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	hellos := make(chan []byte, 1)
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6109",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		OnClientHelloBytes: func(remote net.Addr, hello []byte) {
+			hellos <- hello
+		},
+	}
+
+	It("Should capture the records carrying the ClientHello", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6109", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		var hello []byte
+		Eventually(hellos).Should(Receive(&hello))
+		Expect(len(hello)).To(BeNumerically(">", 9))
+		Expect(hello[0]).To(Equal(byte(tlsRecordTypeHandshake)))
+		Expect(len(hello)).To(Equal(5 + int(hello[3])<<8 + int(hello[4])))
+		Expect(hello[5]).To(Equal(byte(0x01)))
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Certificate selection", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6089",
+		TLSConfig: &tls.Config{
+			NextProtos: []string{"h2"},
+		},
+	}
+
+	It("Should select certificates with the GetCertificate callback and still route by ALPN", func() {
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		var serverName string
+		err = listener.SetGetCertificate(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverName = hello.ServerName
+			return &cert, nil
+		})
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6089", &tls.Config{InsecureSkipVerify: true, ServerName: "sni.example", NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := h2Listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		Expect(serverName).To(Equal("sni.example"))
+	})
+})
+
+var _ = Describe("Default certificate", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:           "127.0.0.1:6110",
+		DefaultCertificate: &cert,
+		TLSConfig: &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return nil, fmt.Errorf("no certificate for %s", hello.ServerName)
+			},
+		},
+	}
+
+	It("Should serve the default certificate when GetCertificate has no match", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6110", &tls.Config{InsecureSkipVerify: true, ServerName: "unknown.example"})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		Expect(conn.ConnectionState().PeerCertificates[0].Raw).To(Equal(cert.Certificate[0]))
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Protocol client authentication", func() {
+	var grpcListener net.Listener
+
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6090",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"grpc", "h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should require a client certificate only for the protocol", func() {
+		var err error
+		grpcListener, err = listener.ProtocolWithClientAuth("grpc", tls.RequireAnyClientCert)
+		Expect(err).To(BeNil())
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6090", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:6090", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"grpc"}})
+		if err == nil {
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("Should deliver connections that present a client certificate", func() {
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6090", &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"grpc"},
+			Certificates:       []tls.Certificate{cert},
+		})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := grpcListener.Accept()
+		Expect(err).To(BeNil())
+		defer serverConn.Close()
+
+		Expect(serverConn.(*tls.Conn).ConnectionState().PeerCertificates).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Protocol handshake timeout", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:         "127.0.0.1:6093",
+		HandshakeTimeout: 300 * time.Millisecond,
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"grpc", "h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	clientHello := func(proto string) []byte {
+		client, server := net.Pipe()
+		defer server.Close()
+
+		go tls.Client(client, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{proto}}).Handshake()
+
+		hello := make([]byte, 4096)
+		n, _ := server.Read(hello)
+		client.Close()
+
+		return hello[:n]
+	}
+
+	It("Should close connections that don't complete the handshake in time", func() {
+		_, err := listener.ProtocolWithHandshakeTimeout("grpc", time.Second)
+		Expect(err).To(BeNil())
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := net.Dial("tcp", "127.0.0.1:6093")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+	})
+
+	It("Should apply the timeout of the protocol being negotiated", func() {
+		defer listener.Stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:6093")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		_, err = conn.Write(clientHello("grpc"))
+		Expect(err).To(BeNil())
+
+		start := time.Now()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err = io.Copy(io.Discard, conn)
+		Expect(err).To(BeNil())
+		Expect(time.Since(start)).To(BeNumerically(">", 700*time.Millisecond))
+	})
+})
+
+var _ = Describe("ACME challenges", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6100",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should answer challenge handshakes with the challenge certificate", func() {
+		Expect(listener.ACMEChallenge(func(sni string) *tls.Certificate {
+			if sni != "challenge.example" {
+				return nil
+			}
+
+			return &cert
+		})).To(BeNil())
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6100", &tls.Config{InsecureSkipVerify: true, ServerName: "challenge.example", NextProtos: []string{"acme-tls/1"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		Expect(conn.ConnectionState().NegotiatedProtocol).To(Equal("acme-tls/1"))
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:6100", &tls.Config{InsecureSkipVerify: true, ServerName: "other.example", NextProtos: []string{"acme-tls/1"}})
+		if err == nil {
+			conn.Close()
+		}
+		Expect(err).ToNot(BeNil())
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:6100", &tls.Config{InsecureSkipVerify: true, ServerName: "other.example", NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Unsupported versions", func() {
+	var legacy chan string
+
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6118",
+		OnUnsupportedVersion: func(hello *tls.ClientHelloInfo) {
+			legacy <- hello.ServerName
+		},
+		TLSConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should report clients offering only versions below the minimum", func() {
+		legacy = make(chan string, 2)
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		_, err := tls.Dial("tcp", "127.0.0.1:6118", &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "legacy.example",
+			MinVersion:         tls.VersionTLS10,
+			MaxVersion:         tls.VersionTLS11,
+		})
+		Expect(err).ToNot(BeNil())
+		Eventually(legacy).Should(Receive(Equal("legacy.example")))
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6118", &tls.Config{InsecureSkipVerify: true, ServerName: "modern.example"})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+		Consistently(legacy).ShouldNot(Receive())
+	})
+})
+
+var _ = Describe("Dynamic record sizing", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+
+	It("Should disable dynamic record sizing without modifying the TLS configuration", func() {
+		listener := &Listener{
+			DisableDynamicRecordSizing: true,
+			TLSConfig: &tls.Config{
+				NextProtos:   []string{"h2"},
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+
+		_, err := listener.ProtocolWithClientAuth("h2", tls.RequireAnyClientCert)
+		Expect(err).To(BeNil())
+
+		listener.prepareConfig()
+		Expect(listener.serverConfig().DynamicRecordSizingDisabled).To(BeTrue())
+		Expect(listener.protocolConfig("h2").DynamicRecordSizingDisabled).To(BeTrue())
+		Expect(listener.TLSConfig.DynamicRecordSizingDisabled).To(BeFalse())
+	})
+})
+
+var _ = Describe("Protocol client certificates", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(leaf)
+
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6125",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"grpc", "h2"},
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    clientCAs,
+		},
+	}
+
+	It("Should only deliver connections with a verified client certificate", func() {
+		grpcListener, err := listener.ProtocolRequireClientCert("grpc")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6125", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"grpc"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		Eventually(listener.Errors()).Should(Receive(MatchError(ContainSubstring("grpc listener requires a verified client certificate"))))
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:6125", &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"grpc"},
+			Certificates:       []tls.Certificate{cert},
+		})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := grpcListener.Accept()
+		Expect(err).To(BeNil())
+		defer serverConn.Close()
+
+		Expect(serverConn.(*tls.Conn).ConnectionState().VerifiedChains).ToNot(BeEmpty())
+	})
+})
+
+var _ = Describe("Early routing", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:     "127.0.0.1:6136",
+		EarlyRouting: true,
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2", "grpc"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should route connections by the protocols in the ClientHello", func() {
+		grpcListener, err := listener.Protocol("grpc")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		Expect(listener.protocolConfig("grpc").NextProtos).To(Equal([]string{"grpc"}))
+		Expect(listener.protocolConfig("h2")).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6136", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"grpc"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		Expect(conn.ConnectionState().NegotiatedProtocol).To(Equal("grpc"))
+
+		serverConn, err := grpcListener.Accept()
+		Expect(err).To(BeNil())
+		defer serverConn.Close()
+
+		tracked, _ := ConnFrom(serverConn)
+		Expect(tracked.route).To(Equal("grpc"))
+		Expect(tracked.Proto()).To(Equal("grpc"))
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:6136", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "grpc"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		Expect(conn.ConnectionState().NegotiatedProtocol).To(Equal("h2"))
+
+		serverConn, err = listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Protocol preference", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6138",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2", "http/1.1"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should only accept an order of the configured protocols", func() {
+		Expect(listener.SetProtocolPreference([]string{"h2"})).To(MatchError("protocol preference must list the 2 configured protocols: [h2]"))
+		Expect(listener.SetProtocolPreference([]string{"h2", "h2"})).To(MatchError("protocol listed more than once: h2"))
+		Expect(listener.SetProtocolPreference([]string{"h2", "grpc"})).To(MatchError("protocol preference is missing configured protocol: http/1.1"))
+	})
+
+	It("Should negotiate by the new order", func() {
+		httpListener, err := listener.Protocol("http/1.1")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		Expect(listener.SetProtocolPreference([]string{"http/1.1", "h2"})).To(BeNil())
+		Expect(listener.TLSConfig.NextProtos).To(Equal([]string{"h2", "http/1.1"}))
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6138", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		Expect(conn.ConnectionState().NegotiatedProtocol).To(Equal("http/1.1"))
+
+		serverConn, err := httpListener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Protocol early data", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+
+	It("Should clear the early data flag of tickets issued for the protocol", func() {
+		var earlyData []bool
+		listener := &Listener{
+			TLSConfig: &tls.Config{
+				NextProtos:   []string{"h2", "grpc"},
+				Certificates: []tls.Certificate{cert},
+				WrapSession: func(state tls.ConnectionState, session *tls.SessionState) ([]byte, error) {
+					earlyData = append(earlyData, session.EarlyData)
+					return nil, nil
+				},
+			},
+		}
+
+		_, err := listener.ProtocolRejectEarlyData("h2")
+		Expect(err).To(BeNil())
+		_, err = listener.Protocol("grpc")
+		Expect(err).To(BeNil())
+
+		listener.prepareConfig()
+		Expect(listener.protocolConfig("grpc")).To(BeNil())
+
+		_, err = listener.protocolConfig("h2").WrapSession(tls.ConnectionState{}, &tls.SessionState{EarlyData: true})
+		Expect(err).To(BeNil())
+		_, err = listener.serverConfig().WrapSession(tls.ConnectionState{}, &tls.SessionState{EarlyData: true})
+		Expect(err).To(BeNil())
+
+		Expect(earlyData).To(Equal([]bool{false, true}))
+	})
+})
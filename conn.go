@@ -0,0 +1,256 @@
+package tlsprotocol
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn is the raw connection the listener places
+// underneath each delivered connection, the TLS
+// connection handed out still reads and writes
+// through it so the listener can track the
+// connection for its whole lifetime
+type Conn struct {
+	net.Conn
+
+	// id uniquely identifies the connection
+	// among those accepted by the listener
+	id uint64
+
+	// worker is the index of the
+	// worker that accepted the connection
+	worker int
+
+	// label is set from the ClientHello
+	// by the listener's Labeler
+	label string
+
+	// route is the ALPN Protocol chosen from
+	// the ClientHello with EarlyRouting
+	route string
+
+	// proto is the ALPN Protocol negotiated
+	// for the connection, set on delivery
+	proto string
+
+	// handshake is how long the
+	// TLS handshake took to complete
+	handshake time.Duration
+
+	// acceptedAt is when the connection was accepted
+	// and handshakeCompletedAt when its TLS handshake
+	// completed, zero if it hasn't or never will
+	acceptedAt           time.Time
+	handshakeCompletedAt time.Time
+
+	// idleTimeout, if set, is how long the connection
+	// can go without a read or write before it's closed,
+	// lastActive is the time in nanoseconds the most
+	// recent read or write returned
+	idleTimeout time.Duration
+	lastActive  atomic.Int64
+
+	// clock is the clock of the listener
+	// that accepted the connection
+	clock clock
+
+	// records, if set, follows the TLS records
+	// read to spot renegotiation attempts
+	records *recordWatcher
+
+	// ctx is cancelled by cancel
+	// when the connection is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// onClose are called once when the connection
+	// is first closed, closed is set once they have
+	// been taken and both are guarded by closeLock
+	onClose   []func()
+	closed    bool
+	closeLock sync.Mutex
+}
+
+// newConn wraps the raw connection
+// accepted by a worker
+func newConn(conn net.Conn, id uint64, worker int) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{Conn: conn, id: id, worker: worker, ctx: ctx, cancel: cancel}
+}
+
+// ConnFrom returns the Conn underneath a connection
+// delivered by a listener, it unwraps the TLS connection
+// and any wrapper that exposes a `NetConn() net.Conn`
+// method to find it
+func ConnFrom(conn net.Conn) (*Conn, bool) {
+	for conn != nil {
+		switch wrapped := conn.(type) {
+		case *Conn:
+			return wrapped, true
+
+		case *tls.Conn:
+			conn = wrapped.NetConn()
+
+		case interface{ NetConn() net.Conn }:
+			conn = wrapped.NetConn()
+
+		default:
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+// tlsConnFrom returns the TLS connection a connection
+// delivered by the listener is or wraps, unwrapping it
+// like ConnFrom, plaintext connections have none
+func tlsConnFrom(conn net.Conn) (*tls.Conn, bool) {
+	for conn != nil {
+		switch wrapped := conn.(type) {
+		case *tls.Conn:
+			return wrapped, true
+
+		case interface{ NetConn() net.Conn }:
+			conn = wrapped.NetConn()
+
+		default:
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+// ID returns the identifier the listener assigned
+// to the connection when it was accepted, IDs count
+// up from 1 for each listener
+func (conn *Conn) ID() uint64 {
+	return conn.id
+}
+
+// Worker returns the index of the listener's
+// worker that accepted the connection
+func (conn *Conn) Worker() int {
+	return conn.worker
+}
+
+// Label returns the label the listener's Labeler
+// gave the connection, it is empty if there is no
+// Labeler or the handshake didn't reach it
+func (conn *Conn) Label() string {
+	return conn.label
+}
+
+// Proto returns the ALPN Protocol negotiated
+// by the connection's handshake, it is empty if
+// no protocol was negotiated or before delivery
+func (conn *Conn) Proto() string {
+	return conn.proto
+}
+
+// AcceptedAt returns when the listener accepted
+// the connection, comparing it with the time the
+// connection is consumed shows how long it was
+// handshaking and then queued
+func (conn *Conn) AcceptedAt() time.Time {
+	return conn.acceptedAt
+}
+
+// HandshakeCompletedAt returns when the TLS handshake
+// of the connection completed, the time since then is
+// how long the connection waited to be consumed. It's
+// zero for connections delivered without a handshake
+// (i.e. by the plaintext listener)
+func (conn *Conn) HandshakeCompletedAt() time.Time {
+	return conn.handshakeCompletedAt
+}
+
+// Context returns a context that is cancelled once
+// the connection is closed, so work done for the
+// connection can be tied to its lifetime
+func (conn *Conn) Context() context.Context {
+	return conn.ctx
+}
+
+// now returns the current time from the clock of
+// the listener that accepted the connection, or
+// the wall clock if it wasn't accepted by one
+func (conn *Conn) now() time.Time {
+	if conn.clock == nil {
+		return time.Now()
+	}
+
+	return conn.clock.Now()
+}
+
+// Read reads from the underlying connection,
+// following its TLS records for renegotiation
+// and recording the activity for the IdleTimeout
+func (conn *Conn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if conn.records != nil {
+		conn.records.observe(b[:n])
+	}
+
+	if conn.idleTimeout > 0 {
+		conn.lastActive.Store(conn.now().UnixNano())
+	}
+
+	return n, err
+}
+
+// Write writes to the underlying connection,
+// recording the activity for the IdleTimeout
+func (conn *Conn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	if conn.idleTimeout > 0 {
+		conn.lastActive.Store(conn.now().UnixNano())
+	}
+
+	return n, err
+}
+
+// Close closes the underlying connection, the
+// first call will also run the close callbacks
+// and cancel the connection's context
+func (conn *Conn) Close() error {
+	err := conn.Conn.Close()
+
+	conn.closeLock.Lock()
+	if conn.closed {
+		conn.closeLock.Unlock()
+		return err
+	}
+
+	conn.closed = true
+	onClose := conn.onClose
+	conn.onClose = nil
+	conn.closeLock.Unlock()
+
+	conn.cancel()
+	for i := range onClose {
+		onClose[i]()
+	}
+
+	return err
+}
+
+// addOnClose registers a callback to run when the
+// connection is first closed, it runs straight away
+// if the connection has already been closed
+func (conn *Conn) addOnClose(callback func()) {
+	conn.closeLock.Lock()
+	if conn.closed {
+		conn.closeLock.Unlock()
+		callback()
+		return
+	}
+
+	conn.onClose = append(conn.onClose, callback)
+	conn.closeLock.Unlock()
+}
@@ -0,0 +1,71 @@
+package tlsprotocol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Debug returns a human-readable snapshot of the
+// listener's internal state, the bind address, the
+// state of each worker and the depth of each channel,
+// for diagnosing a stuck listener (i.e. from an admin
+// endpoint). The format isn't stable and shouldn't
+// be parsed, use Stats() for the channel depths
+func (listener *Listener) Debug() string {
+	var out strings.Builder
+
+	fmt.Fprintf(&out, "listener %s", listener.BindAddr)
+	if addrs := listener.Addrs(); len(addrs) > 0 {
+		bound := make([]string, len(addrs))
+		for i := range addrs {
+			bound[i] = addrs[i].String()
+		}
+
+		fmt.Fprintf(&out, " (bound %s)", strings.Join(bound, ", "))
+	}
+
+	if listener.isDraining() {
+		out.WriteString(" draining")
+	}
+
+	fmt.Fprintf(&out, "\nworkers: %d\n", len(listener.workers))
+	for i := range listener.workers {
+		fmt.Fprintf(&out, "  worker %d: %s\n", listener.workers[i].index, listener.workers[i].state())
+	}
+
+	channels := listener.namedChannels()
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(&out, "channels: %d\n", len(channels))
+	for _, name := range names {
+		fmt.Fprintf(&out, "  %s: %d/%d\n", name, len(channels[name]), cap(channels[name]))
+	}
+
+	fmt.Fprintf(&out, "errors: %d/%d\n", len(listener.errors), cap(listener.errors))
+	fmt.Fprintf(&out, "handshakes in flight: %d\n", listener.inFlight.Load())
+
+	return out.String()
+}
+
+// state describes if the worker is running,
+// paused, stopped or exited after its socket failed
+func (worker *worker) state() string {
+	worker.lock.Lock()
+	defer worker.lock.Unlock()
+
+	switch {
+	case worker.exitErr != nil:
+		return fmt.Sprintf("exited (%s)", worker.exitErr)
+	case worker.running:
+		return "running"
+	case worker.paused:
+		return "paused"
+	default:
+		return "stopped"
+	}
+}
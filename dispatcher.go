@@ -0,0 +1,51 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+)
+
+// Dispatcher decides which Protocol listener receives
+// each TLS connection once its handshake has completed,
+// so connections can be routed by more than their ALPN
+// Protocol (i.e. by SNI or the client certificate)
+type Dispatcher interface {
+	// Dispatch returns the ALPN Protocol of the Protocol
+	// listener to deliver the connection to, returning
+	// false or a target without a Protocol listener
+	// delivers it to the default listener. It's called
+	// before the connection is delivered so it must not
+	// read from or write to the connection
+	Dispatch(conn *tls.Conn, state tls.ConnectionState) (target string, ok bool)
+}
+
+// alpnDispatcher is the Dispatcher used when the
+// listener has none set, it routes connections by
+// the ALPN Protocol they negotiated
+type alpnDispatcher struct {
+	listener *Listener
+}
+
+// Dispatch returns the route chosen from the ClientHello
+// with EarlyRouting, otherwise the negotiated ALPN Protocol
+// if it's mutual or IgnoreMutualALPN is set
+func (dispatcher alpnDispatcher) Dispatch(conn *tls.Conn, state tls.ConnectionState) (string, bool) {
+	if tracked, ok := ConnFrom(conn); ok && tracked.route != "" {
+		return tracked.route, true
+	}
+
+	if !state.NegotiatedProtocolIsMutual && !dispatcher.listener.IgnoreMutualALPN {
+		return "", false
+	}
+
+	return state.NegotiatedProtocol, true
+}
+
+// dispatcher returns the listener's Dispatcher,
+// defaulting to routing by ALPN Protocol
+func (listener *Listener) dispatcher() Dispatcher {
+	if listener.Dispatcher == nil {
+		return alpnDispatcher{listener: listener}
+	}
+
+	return listener.Dispatcher
+}
@@ -0,0 +1,129 @@
+package tlsprotocol
+
+import (
+	"net"
+	"time"
+)
+
+// eventsBuffer is the number of ConnEvents
+// that can be waiting for the consumer of
+// Events(), further events are dropped
+const eventsBuffer = 64
+
+// ConnOutcome is what became of the
+// connection a ConnEvent describes
+type ConnOutcome int
+
+const (
+	// ConnRouted is a connection queued
+	// in the channel of a listener
+	ConnRouted ConnOutcome = iota
+
+	// ConnHandshakeFailed is a connection
+	// closed as its TLS handshake failed
+	ConnHandshakeFailed
+
+	// ConnLimited is a connection closed
+	// before its handshake as its remote
+	// IP was over MaxConnsPerIP or it was
+	// shed by MaxHandshakesPerSecond
+	ConnLimited
+
+	// ConnDropped is a connection closed as
+	// the channel of the listener it was being
+	// routed to was full, or it was the oldest
+	// connection queued in the channel when
+	// OverflowDropOldest made room, see OverflowPolicy
+	ConnDropped
+
+	// ConnRejected is a connection closed as an
+	// AcceptFilter rejected it, a Middleware returned
+	// an error or it had no verified client certificate
+	// for a Protocol requiring one
+	ConnRejected
+)
+
+// ConnEvent describes a connection the listener
+// has routed or rejected
+type ConnEvent struct {
+	// Time is when the connection was
+	// routed or rejected
+	Time time.Time
+
+	// ID is the identifier of the connection,
+	// see Conn.ID()
+	ID uint64
+
+	// RemoteAddr is the address of the client
+	RemoteAddr net.Addr
+
+	// Proto is the negotiated ALPN Protocol,
+	// empty if none was negotiated
+	Proto string
+
+	// Listener is the name of the listener the
+	// connection was routed to, the ALPN Protocol
+	// or "default", "plaintext" or "drain", it is
+	// empty if the handshake didn't complete
+	Listener string
+
+	// HandshakeDuration is how long the TLS
+	// handshake took to complete or fail
+	HandshakeDuration time.Duration
+
+	// Outcome is what became of the connection
+	Outcome ConnOutcome
+}
+
+// Events returns a channel receiving a ConnEvent for
+// every connection the listener routes or rejects, so
+// connections can be monitored without consuming them.
+// Events are dropped if the channel is full so a slow
+// consumer never holds up the listener, the channel is
+// closed when the listener stops
+func (listener *Listener) Events() <-chan ConnEvent {
+	listener.eventsLock.Lock()
+	defer listener.eventsLock.Unlock()
+
+	if listener.events == nil {
+		listener.events = make(chan ConnEvent, eventsBuffer)
+	}
+
+	return listener.events
+}
+
+// Observe returns the channel of Events()
+//
+// Deprecated: use Events, which also receives
+// the connections the listener rejects
+func (listener *Listener) Observe() <-chan ConnEvent {
+	return listener.Events()
+}
+
+// emitEvent queues the event for the consumer
+// of Events(), if there is one and it has room
+func (listener *Listener) emitEvent(event ConnEvent) {
+	listener.eventsLock.Lock()
+	defer listener.eventsLock.Unlock()
+
+	if listener.events == nil {
+		return
+	}
+
+	select {
+	case listener.events <- event:
+	default:
+	}
+}
+
+// closeEvents closes the channel returned by
+// Events(), a later call creates a new one
+func (listener *Listener) closeEvents() {
+	listener.eventsLock.Lock()
+	defer listener.eventsLock.Unlock()
+
+	if listener.events != nil {
+		close(listener.events)
+		listener.events = nil
+	}
+}
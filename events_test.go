@@ -0,0 +1,71 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+)
+
+var _ = Describe("Connection events", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6119",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should return the events channel from the deprecated Observe", func() {
+		Expect(listener.Observe()).To(Equal(listener.Events()))
+	})
+
+	It("Should emit an event for every routed connection", func() {
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		events := listener.Events()
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6119", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := h2Listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		var event ConnEvent
+		Eventually(events).Should(Receive(&event))
+		Expect(event.ID).To(Equal(uint64(1)))
+		Expect(event.Proto).To(Equal("h2"))
+		Expect(event.Listener).To(Equal("h2"))
+		Expect(event.RemoteAddr.String()).To(Equal(conn.LocalAddr().String()))
+		Expect(event.HandshakeDuration).To(BeNumerically(">", 0))
+		Expect(event.Outcome).To(Equal(ConnRouted))
+	})
+
+	It("Should emit an event for connections failing the handshake", func() {
+		events := listener.Events()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:6119")
+		Expect(err).To(BeNil())
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		Expect(err).To(BeNil())
+		conn.Close()
+
+		var event ConnEvent
+		Eventually(events).Should(Receive(&event))
+		Expect(event.Outcome).To(Equal(ConnHandshakeFailed))
+		Expect(event.Listener).To(BeEmpty())
+	})
+
+	It("Should close the channel when the listener stops", func() {
+		events := listener.Events()
+		listener.Stop()
+
+		Eventually(events).Should(BeClosed())
+	})
+})
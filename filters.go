@@ -0,0 +1,168 @@
+package tlsprotocol
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// AcceptFilter is called with each accepted connection
+// before the handshake, returning false rejects the
+// connection and has it closed, a returned error is
+// also reported by Errors()
+type AcceptFilter func(conn net.Conn) (bool, error)
+
+// filterConnection passes the connection through the
+// AcceptFilters stopping at the first that rejects it
+func (listener *Listener) filterConnection(conn net.Conn) bool {
+	for i := range listener.AcceptFilters {
+		allow, err := listener.AcceptFilters[i](conn)
+		if err != nil {
+			listener.reportError(fmt.Errorf("connection from %s rejected: %w", conn.RemoteAddr(), err))
+		}
+
+		if !allow {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AllowCIDRs returns a filter that only allows
+// connections from remote IP addresses within
+// one of the CIDR blocks (i.e. "10.0.0.0/8")
+func AllowCIDRs(cidrs ...string) (AcceptFilter, error) {
+	blocks, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(conn net.Conn) (bool, error) {
+		return blocks.contains(conn), nil
+	}, nil
+}
+
+// DenyCIDRs returns a filter that rejects
+// connections from remote IP addresses within
+// one of the CIDR blocks (i.e. "10.0.0.0/8")
+func DenyCIDRs(cidrs ...string) (AcceptFilter, error) {
+	blocks, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(conn net.Conn) (bool, error) {
+		return !blocks.contains(conn), nil
+	}, nil
+}
+
+// cidrBlocks are the networks
+// of a CIDR allow or deny filter
+type cidrBlocks []*net.IPNet
+
+// parseCIDRs parses the CIDR blocks of a filter
+func parseCIDRs(cidrs []string) (cidrBlocks, error) {
+	blocks := make(cidrBlocks, 0, len(cidrs))
+	for i := range cidrs {
+		_, block, err := net.ParseCIDR(cidrs[i])
+		if err != nil {
+			return nil, fmt.Errorf("parse CIDR block: %w", err)
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+// contains reports if the remote IP address of
+// the connection is within one of the blocks
+func (blocks cidrBlocks) contains(conn net.Conn) bool {
+	ip := net.ParseIP(remoteIP(conn))
+	if ip == nil {
+		return false
+	}
+
+	for i := range blocks {
+		if blocks[i].Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RateLimit returns a filter that allows `burst`
+// connections at once and then refills at `rate`
+// connections per second, connections arriving
+// while there are none left are rejected
+func RateLimit(rate float64, burst int) AcceptFilter {
+	limiter := &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+	return func(conn net.Conn) (bool, error) {
+		now := time.Now()
+		if tracked, ok := conn.(*Conn); ok {
+			now = tracked.now()
+		}
+
+		return limiter.allow(now), nil
+	}
+}
+
+// rateLimiter is the token
+// bucket of a RateLimit filter
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// allow refills the bucket for the time since
+// the last call and then takes a token from it
+func (limiter *rateLimiter) allow(now time.Time) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if !limiter.last.IsZero() {
+		limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+		if limiter.tokens > limiter.burst {
+			limiter.tokens = limiter.burst
+		}
+	}
+	limiter.last = now
+
+	if limiter.tokens < 1 {
+		return false
+	}
+
+	limiter.tokens--
+	return true
+}
+
+// PerIPLimit returns a filter that limits the
+// number of connections each remote IP address
+// can have open at once, like MaxConnsPerIP but
+// it can be ordered with the other filters
+func PerIPLimit(limit int) AcceptFilter {
+	counter := &ipCounter{}
+	return func(conn net.Conn) (bool, error) {
+		tracked, ok := conn.(*Conn)
+		if !ok {
+			return true, nil
+		}
+
+		ip := remoteIP(conn)
+		if !counter.acquire(ip, limit) {
+			return false, nil
+		}
+
+		tracked.addOnClose(func() {
+			counter.release(ip)
+		})
+
+		return true, nil
+	}
+}
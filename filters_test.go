@@ -0,0 +1,112 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("Accept filters", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	newListener := func(filters ...AcceptFilter) *Listener {
+		return &Listener{
+			BindAddr:      "127.0.0.1:6123",
+			AcceptFilters: filters,
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+	}
+
+	It("Should stop at the first filter rejecting the connection", func() {
+		var called atomic.Bool
+		deny, err := DenyCIDRs("127.0.0.0/8")
+		Expect(err).To(BeNil())
+
+		listener := newListener(deny, func(conn net.Conn) (bool, error) {
+			called.Store(true)
+			return true, nil
+		})
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		_, err = tls.Dial("tcp", "127.0.0.1:6123", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).ToNot(BeNil())
+		Expect(called.Load()).To(BeFalse())
+	})
+
+	It("Should deliver connections every filter allows", func() {
+		allow, err := AllowCIDRs("10.0.0.0/8", "127.0.0.1/32")
+		Expect(err).To(BeNil())
+
+		listener := newListener(allow, PerIPLimit(1))
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6123", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		defer serverConn.Close()
+
+		_, err = tls.Dial("tcp", "127.0.0.1:6123", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("Should release the per IP count of connections closed before the filter", func() {
+		filter := PerIPLimit(1)
+
+		for i := uint64(1); i <= 2; i++ {
+			_, server := net.Pipe()
+			conn := newConn(server, i, 0)
+			Expect(conn.Close()).To(Succeed())
+
+			allowed, err := filter(conn)
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeTrue())
+		}
+	})
+
+	It("Should refill the rate limit with the listener's clock", func() {
+		clock := &fakeClock{now: time.Now()}
+		filter := RateLimit(1, 1)
+
+		_, server := net.Pipe()
+		conn := newConn(server, 1, 0)
+		conn.clock = clock
+
+		for _, allow := range []bool{true, false} {
+			allowed, err := filter(conn)
+			Expect(err).To(BeNil())
+			Expect(allowed).To(Equal(allow))
+		}
+
+		clock.Advance(time.Second)
+		allowed, err := filter(conn)
+		Expect(err).To(BeNil())
+		Expect(allowed).To(BeTrue())
+	})
+
+	It("Should refuse invalid CIDR blocks", func() {
+		_, err := AllowCIDRs("127.0.0.1")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("Should refill the rate limit over time", func() {
+		limiter := &rateLimiter{rate: 10, burst: 2, tokens: 2}
+		now := time.Unix(1000, 0)
+
+		Expect(limiter.allow(now)).To(BeTrue())
+		Expect(limiter.allow(now)).To(BeTrue())
+		Expect(limiter.allow(now)).To(BeFalse())
+		Expect(limiter.allow(now.Add(100 * time.Millisecond))).To(BeTrue())
+		Expect(limiter.allow(now.Add(time.Hour))).To(BeTrue())
+		Expect(limiter.allow(now.Add(time.Hour))).To(BeTrue())
+		Expect(limiter.allow(now.Add(time.Hour))).To(BeFalse())
+	})
+})
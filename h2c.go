@@ -0,0 +1,136 @@
+package tlsprotocol
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// h2cPreface is the connection preface a cleartext
+// HTTP/2 client with prior knowledge sends first
+const h2cPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// defaultH2CPrefaceTimeout is how long a client has
+// to send enough of the HTTP/2 preface to be routed if
+// the plaintext listener's HandshakeTimeout isn't set
+const defaultH2CPrefaceTimeout = 10 * time.Second
+
+// h2cListener is a net.Listener that receives the
+// connections of a plaintext listener that aren't
+// HTTP/2 with prior knowledge
+type h2cListener struct {
+	net.Listener
+	serveConn func(conn net.Conn)
+	timeout   time.Duration
+
+	conns  chan net.Conn
+	failed chan struct{}
+	err    error
+}
+
+// H2CListener splits the connections of a plaintext
+// listener (see PlaintextListener()) between cleartext
+// HTTP/2 clients with prior knowledge and everyone else.
+//
+// Connections starting with the HTTP/2 preface are
+// passed to serveConn, in their own go routine, with the
+// preface replayed so it can be used with a http2.Server,
+// every other connection is returned by the listener's
+// Accept() so it can be served by an http.Server that
+// handles the HTTP/1.1 upgrade to h2c. For example
+// with golang.org/x/net/http2:
+//
+//	h2s := &http2.Server{}
+//	http1 := tlsprotocol.H2CListener(plaintext, func(conn net.Conn) {
+//		h2s.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+//	})
+//
+//	http.Serve(http1, h2c.NewHandler(handler, h2s))
+//
+// A client that doesn't send enough to be routed within
+// the parent listener's HandshakeTimeout, or 10 seconds
+// if it isn't set, is closed.
+//
+// Closing the returned listener closes the plaintext listener
+func H2CListener(plaintext net.Listener, serveConn func(conn net.Conn)) net.Listener {
+	listener := &h2cListener{
+		Listener:  plaintext,
+		serveConn: serveConn,
+		timeout:   defaultH2CPrefaceTimeout,
+		conns:     make(chan net.Conn),
+		failed:    make(chan struct{}),
+	}
+
+	if protocol, ok := plaintext.(*Protocol); ok && protocol.parent.HandshakeTimeout > 0 {
+		listener.timeout = protocol.parent.HandshakeTimeout
+	}
+
+	go listener.run()
+	return listener
+}
+
+// run accepts connections from the plaintext
+// listener until it fails (i.e. it's closed)
+func (listener *h2cListener) run() {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			listener.err = err
+			close(listener.failed)
+			return
+		}
+
+		go listener.route(conn)
+	}
+}
+
+// route reads from the connection until it's known
+// if the client sent the HTTP/2 preface, the bytes
+// read are replayed for whoever gets the connection
+func (listener *h2cListener) route(conn net.Conn) {
+	if err := conn.SetReadDeadline(time.Now().Add(listener.timeout)); err != nil {
+		conn.Close()
+		return
+	}
+
+	buffer := make([]byte, 0, len(h2cPreface))
+	for len(buffer) < len(h2cPreface) && strings.HasPrefix(h2cPreface, string(buffer)) {
+		n, err := conn.Read(buffer[len(buffer):cap(buffer)])
+		buffer = buffer[:len(buffer)+n]
+
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return
+	}
+
+	replay := NewPrefixConn(conn, buffer)
+	if string(buffer) == h2cPreface {
+		listener.serveConn(replay)
+		return
+	}
+
+	select {
+	case listener.conns <- replay:
+	case <-listener.failed:
+		conn.Close()
+	}
+}
+
+// Accept will block until a connection that isn't
+// HTTP/2 with prior knowledge is received, it returns
+// the error of the plaintext listener once it fails
+func (listener *h2cListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+
+	case <-listener.failed:
+		return nil, listener.err
+	}
+}
@@ -0,0 +1,132 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+	"time"
+)
+
+var _ = Describe("H2C listener", func() {
+	var h2cConns chan net.Conn
+	var http1Listener net.Listener
+
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6116",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should split the plaintext listener", func() {
+		plaintextListener, err := listener.PlaintextListener()
+		Expect(err).To(BeNil())
+
+		h2cConns = make(chan net.Conn, 1)
+		http1Listener = H2CListener(plaintextListener, func(conn net.Conn) {
+			h2cConns <- conn
+		})
+
+		Expect(listener.Start()).To(BeNil())
+	})
+
+	It("Should serve clients with prior knowledge with the preface replayed", func() {
+		conn, err := net.Dial("tcp", "127.0.0.1:6116")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(h2cPreface))
+		Expect(err).To(BeNil())
+
+		var h2cConn net.Conn
+		Eventually(h2cConns).Should(Receive(&h2cConn))
+		defer h2cConn.Close()
+
+		buffer := make([]byte, len(h2cPreface))
+		_, err = io.ReadFull(h2cConn, buffer)
+		Expect(err).To(BeNil())
+		Expect(string(buffer)).To(Equal(h2cPreface))
+	})
+
+	It("Should deliver other clients to the listener", func() {
+		conn, err := net.Dial("tcp", "127.0.0.1:6116")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		Expect(err).To(BeNil())
+
+		http1Conn, err := http1Listener.Accept()
+		Expect(err).To(BeNil())
+		defer http1Conn.Close()
+
+		buffer := make([]byte, 5)
+		_, err = io.ReadFull(http1Conn, buffer)
+		Expect(err).To(BeNil())
+		Expect(string(buffer)).To(Equal("GET /"))
+	})
+
+	It("Should fail once the listener is stopped", func() {
+		listener.Stop()
+
+		conn, err := http1Listener.Accept()
+		Expect(conn).To(BeNil())
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("H2C preface timeout", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:         "127.0.0.1:6153",
+		HandshakeTimeout: 100 * time.Millisecond,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should close clients that stall part way through the preface", func() {
+		plaintextListener, err := listener.PlaintextListener()
+		Expect(err).To(BeNil())
+
+		http1Listener := H2CListener(plaintextListener, func(conn net.Conn) {
+			conn.Close()
+		})
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:6153")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(h2cPreface[:4]))
+		Expect(err).To(BeNil())
+
+		Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+
+		conn, err = net.Dial("tcp", "127.0.0.1:6153")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n"))
+		Expect(err).To(BeNil())
+
+		http1Conn, err := http1Listener.Accept()
+		Expect(err).To(BeNil())
+		defer http1Conn.Close()
+
+		time.Sleep(150 * time.Millisecond)
+		_, err = conn.Write([]byte("\r\n"))
+		Expect(err).To(BeNil())
+
+		buffer := make([]byte, len("GET / HTTP/1.1\r\n\r\n"))
+		_, err = io.ReadFull(http1Conn, buffer)
+		Expect(err).To(BeNil())
+	})
+})
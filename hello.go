@@ -0,0 +1,65 @@
+package tlsprotocol
+
+import (
+	"fmt"
+	"net"
+)
+
+// helloConn watches the bytes read from a connection
+// until its ClientHello has been received, it limits
+// how many can be read and can capture them. Reads are
+// only made by the handshake so it needs no locking
+type helloConn struct {
+	net.Conn
+
+	// limit is the maximum bytes that can be read
+	// before the ClientHello is received, 0 is no limit
+	limit    int
+	read     int
+	exceeded bool
+
+	// capture keeps the bytes read before the
+	// ClientHello is received in captured
+	capture  bool
+	captured []byte
+
+	received bool
+}
+
+// Read fails once more than the limit has been
+// read and the ClientHello hasn't been received
+func (conn *helloConn) Read(b []byte) (int, error) {
+	if conn.received {
+		return conn.Conn.Read(b)
+	}
+
+	if conn.limit > 0 && conn.read+len(b) > conn.limit {
+		if conn.read >= conn.limit {
+			conn.exceeded = true
+			return 0, fmt.Errorf("ClientHello exceeds %d bytes", conn.limit)
+		}
+
+		b = b[:conn.limit-conn.read]
+	}
+
+	n, err := conn.Conn.Read(b)
+	conn.read += n
+
+	if conn.capture {
+		conn.captured = append(conn.captured, b[:n]...)
+	}
+
+	return n, err
+}
+
+// helloReceived is called once the ClientHello
+// has been read and returns the bytes captured
+func (conn *helloConn) helloReceived() []byte {
+	conn.received = true
+	return conn.captured
+}
+
+// NetConn returns the watched connection
+func (conn *helloConn) NetConn() net.Conn {
+	return conn.Conn
+}
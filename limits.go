@@ -0,0 +1,56 @@
+package tlsprotocol
+
+import (
+	"net"
+	"sync"
+)
+
+// ipCounter counts the active connections
+// of each remote IP address, entries are
+// removed once they reach zero so the map
+// only holds addresses that are connected
+type ipCounter struct {
+	counts map[string]int
+	lock   sync.Mutex
+}
+
+// acquire increments the count for the IP
+// address unless it's already at the limit
+func (counter *ipCounter) acquire(ip string, limit int) bool {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	if counter.counts == nil {
+		counter.counts = make(map[string]int)
+	}
+
+	if counter.counts[ip] >= limit {
+		return false
+	}
+
+	counter.counts[ip]++
+	return true
+}
+
+// release decrements the count for the IP address
+func (counter *ipCounter) release(ip string) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	if counter.counts[ip] <= 1 {
+		delete(counter.counts, ip)
+	} else {
+		counter.counts[ip]--
+	}
+}
+
+// remoteIP returns the IP address portion
+// of a connection's remote address
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
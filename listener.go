@@ -1,14 +1,31 @@
 package tlsprotocol
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
+// errorsBuffer is the number of worker errors
+// that can be queued for Accept() before the
+// oldest errors start being dropped
+const errorsBuffer = 64
+
+// defaultSocketName is the name of the worker
+// socket files when SocketName isn't set
+const defaultSocketName = "tls-Protocol-listener"
+
 // Listener is a TLS connection listener
 // that supports the use of multiple sockets
 // for receiving connections and also supports
@@ -18,6 +35,11 @@ type Listener struct {
 	// and port to bind listening sockets too
 	BindAddr string
 
+	// Resolver, if set, is used to resolve the
+	// host of `BindAddr`, if not set the default
+	// resolver is used
+	Resolver *net.Resolver
+
 	// TLSConfig is the TLS configuration used to
 	// build the TLS listener sockets, ensure that
 	// all required protocols are configured otherwise
@@ -25,11 +47,59 @@ type Listener struct {
 	// the Protocol and will direct it to the default queue
 	TLSConfig *tls.Config
 
+	// DefaultCertificate, if set, is served to clients
+	// the TLS configuration's `GetCertificate` has no
+	// certificate for (i.e. an unknown or absent SNI),
+	// so they complete the handshake and can be turned
+	// away from the default listener. It's preferred over
+	// the configuration's `Certificates` as the fallback
+	DefaultCertificate *tls.Certificate
+
 	// Listeners specifies the number of underlying
 	// sockets to bind for receiving connections, if
-	// not set it will default to 1
+	// not set it will default to 1. SetListeners()
+	// changes it once the listener is started
 	Listeners int
 
+	// DualStack, if set, has a hostname `BindAddr` that
+	// resolves to both IPv4 and IPv6 addresses bound on
+	// both, each family gets its own `Listeners` sockets
+	// and the IPv6 workers are indexed after the IPv4
+	// workers. Addrs() returns both addresses, it has no
+	// effect when `BindAddr` is an IP address or the
+	// hostname resolves to a single family
+	DualStack bool
+
+	// PartialBind decides what Start() does when some but
+	// not all of the sockets fail to bind. By default the
+	// sockets already bound are closed and Start() returns
+	// the error, if set the listener starts with the sockets
+	// that did bind and the errors of the others are reported
+	// by Accept(). Start() always fails if no socket binds
+	PartialBind bool
+
+	// AcceptGoroutines specifies the number of go
+	// routines accepting connections from each socket,
+	// more than one can improve the accept throughput
+	// of a socket when the kernel doesn't spread the
+	// connections well between the sockets, if not set
+	// it will default to 1
+	AcceptGoroutines int
+
+	// CanAccept, if set, is called by the workers before
+	// accepting each connection, while it returns false the
+	// workers stop accepting and let the kernel's accept
+	// queue build up so an application can apply backpressure
+	// when what it depends on is saturated (i.e. a database
+	// pool is exhausted). It's polled every CanAcceptInterval
+	// until it returns true and must be safe to call from
+	// every worker at once
+	CanAccept func() bool
+
+	// CanAcceptInterval is how often CanAccept is polled
+	// while it returns false, defaults to 100 milliseconds
+	CanAcceptInterval time.Duration
+
 	// BufferSize specifies the size of the connection
 	// buffer, the bigger the buffer the more connections
 	// that can be queued to be accepted.
@@ -37,6 +107,301 @@ type Listener struct {
 	// This will default to 1 if unset at Start().
 	BufferSize int
 
+	// AllowServerName, if set, is called with the SNI
+	// server name of each ClientHello, returning false
+	// aborts the handshake with an alert and the
+	// connection is never delivered
+	AllowServerName func(name string) bool
+
+	// InspectClientHello, if set, is called with the
+	// ClientHello of every handshake before it's filtered
+	// or routed, so what clients offer (SNI, ALPN, cipher
+	// suites) can be recorded even for handshakes that
+	// fail or fall to the default listener. It can't
+	// change the negotiation and must not retain hello
+	InspectClientHello func(hello *tls.ClientHelloInfo)
+
+	// Labeler, if set, is called with the ClientHello of
+	// every handshake to label the connection (i.e. by the
+	// client application), the label is available from
+	// the connection's Conn, counted in Stats() and
+	// included in the access log
+	Labeler func(hello *tls.ClientHelloInfo) string
+
+	// OnUnsupportedVersion, if set, is called with the
+	// ClientHello of every handshake offering only TLS
+	// versions below the TLS configuration's MinVersion
+	// so legacy clients can be logged or alerted on,
+	// the handshake then fails with a protocol alert
+	OnUnsupportedVersion func(hello *tls.ClientHelloInfo)
+
+	// OnClientHelloBytes, if set, is called with the raw
+	// bytes of every ClientHello (i.e. for fingerprinting)
+	// once they have been read, they are the TLS records
+	// carrying the ClientHello as the client waits for the
+	// server to respond before sending anything more
+	OnClientHelloBytes func(remote net.Addr, hello []byte)
+
+	// OnRenegotiation, if set, is called with a delivered
+	// connection whose client tries to renegotiate, which
+	// is only possible below TLS 1.3 and may indicate an old
+	// client or an attack, attempts are also counted in Stats().
+	//
+	// crypto/tls servers always refuse renegotiation, the
+	// configuration's Renegotiation only applies to clients,
+	// so the handler's next read fails and the connection is
+	// lost. The attempt is spotted from the unencrypted record
+	// headers as the handshake messages can't be seen, it's
+	// called from the go routine reading the connection
+	OnRenegotiation func(conn *Conn)
+
+	// PeekTimeout is how long to wait for the first
+	// byte from a client when a plaintext listener is
+	// configured, if the client sends nothing in time
+	// it's delivered to the plaintext listener so
+	// protocols where the server speaks first can
+	// share the port. If not set the listener waits
+	// for the client until the HandshakeTimeout.
+	//
+	// Keep this small (i.e. 5ms) but above the round
+	// trip time of expected TLS clients, a slow TLS
+	// client will otherwise be treated as plaintext.
+	PeekTimeout time.Duration
+
+	// HandshakeTimeout is the maximum time a client
+	// has from being accepted to completing the TLS
+	// handshake before it's closed, if not set there
+	// is no limit
+	HandshakeTimeout time.Duration
+
+	// SyncHandshake performs the handshake and delivery
+	// of each connection in the worker's accept loop
+	// instead of a go routine per connection, a worker
+	// won't accept its next connection until the last
+	// has been delivered.
+	//
+	// This suits cheap handshakes (i.e. resumption), or
+	// benchmarks, where go routine churn dominates, use
+	// more Listeners for concurrency and a HandshakeTimeout
+	// so a slow client can't stall a worker.
+	SyncHandshake bool
+
+	// IgnoreMutualALPN routes connections to a Protocol
+	// listener purely by the negotiated protocol name,
+	// by default a connection is only routed when the
+	// state reports `NegotiatedProtocolIsMutual`
+	IgnoreMutualALPN bool
+
+	// EarlyRouting decides the Protocol listener of each
+	// connection from the ALPN Protocols in its ClientHello,
+	// rather than from the handshake's outcome, and completes
+	// the handshake with a configuration offering only that
+	// Protocol alongside any client authentication or
+	// certificate set for it. Handshakes given a configuration
+	// by the TLS configuration's `GetConfigForClient` callback,
+	// or whose chosen Protocol has no listener, are routed
+	// after the handshake as usual
+	EarlyRouting bool
+
+	// Dispatcher, if set, decides the Protocol listener of
+	// each TLS connection in place of routing by the negotiated
+	// ALPN Protocol, EarlyRouting and IgnoreMutualALPN only
+	// apply to the default routing
+	Dispatcher Dispatcher
+
+	// OnFull decides what happens to a connection
+	// when the channel it's being delivered to is
+	// full, defaults to OverflowBlock
+	OnFull OverflowPolicy
+
+	// MaxConnsPerIP limits the number of connections
+	// each remote IP address can have open at once,
+	// connections over the limit are closed before
+	// the handshake. If not set there is no limit
+	MaxConnsPerIP int
+
+	// RejectedBuffer, if set, has connections that are
+	// rejected (by an AcceptFilter, MaxConnsPerIP,
+	// MaxHandshakesPerSecond, a failed handshake, a
+	// Middleware or a Protocol requiring client certificates)
+	// handed to the channel returned by Rejected() instead of
+	// being closed, so they can be inspected or sent a response
+	// first. It's the size of the channel, rejected connections
+	// that don't fit are closed as usual
+	RejectedBuffer int
+
+	// MaxPendingHandshakes limits the number of accepted
+	// connections that haven't completed the handshake,
+	// connections accepted over the limit are closed
+	// without attempting the handshake so half-open
+	// connections can't pile up under attack. If not
+	// set there is no limit
+	MaxPendingHandshakes int
+
+	// MaxHandshakesPerSecond limits the rate of handshakes
+	// across every worker, allowing bursts of up to the
+	// limit. Connections accepted while it's exceeded are
+	// closed without attempting the handshake, shedding
+	// load to protect the CPU during a handshake flood no
+	// matter how many addresses it comes from. If not set
+	// there is no limit
+	MaxHandshakesPerSecond int
+
+	// MaxLifetimeConns, if set, is the number of connections
+	// the listener delivers before it stops accepting and
+	// stops gracefully, waiting up to lifetimeConnsGrace for
+	// the connections to be accepted. Connections already
+	// handshaking are still delivered. It's intended for
+	// test fixtures and one-shot servers, Done() is closed
+	// once the listener has stopped and LifetimeConnsReached()
+	// reports if the limit was the reason
+	MaxLifetimeConns int
+
+	// MaxConnLifetime, if set, is how long a delivered
+	// connection can stay open, once it elapses the
+	// connection is closed even if it's still in use so
+	// clients reconnect periodically (i.e. to pick up new
+	// certificates). If not set there is no limit
+	MaxConnLifetime time.Duration
+
+	// IdleTimeout, if set, is how long a delivered
+	// connection can go without reading or writing
+	// anything before it's closed, the equivalent of
+	// http.Server's IdleTimeout for every protocol. A
+	// read blocked waiting for the client is idle, if
+	// not set connections can be idle indefinitely
+	IdleTimeout time.Duration
+
+	// AcceptFilters are called in order with every
+	// accepted connection before the handshake, the
+	// first filter to reject the connection closes it
+	// and the filters after it aren't called, see
+	// AllowCIDRs(), DenyCIDRs(), RateLimit() and
+	// PerIPLimit() for the built-in filters
+	AcceptFilters []AcceptFilter
+
+	// MaxClientHelloSize limits the bytes a client can
+	// send before its ClientHello has been received,
+	// connections that exceed it are closed and reported
+	// by Errors(). If not set there is no limit beyond
+	// the one crypto/tls applies to handshake messages
+	MaxClientHelloSize int
+
+	// SendBuffer and RecvBuffer, if set, are applied
+	// to each worker socket as SO_SNDBUF and SO_RCVBUF
+	// so bulk transfers can use larger socket buffers,
+	// accepted connections inherit the sizes from the
+	// socket they were accepted on. The kernel may clamp
+	// or adjust the sizes, SocketBuffers() reports the
+	// sizes that took effect
+	SendBuffer int
+	RecvBuffer int
+
+	// FirewallMark, if set, is applied to each worker
+	// socket as SO_MARK so the listener's traffic can be
+	// matched by policy routing and firewall rules, it is
+	// only supported on Linux and needs CAP_NET_ADMIN
+	FirewallMark int
+
+	// ReuseportBPF, if set, is a classic BPF program
+	// attached to the first worker socket (of each
+	// family with DualStack) with
+	// SO_ATTACH_REUSEPORT_CBPF to steer connections
+	// between the worker sockets (i.e. by CPU or hash),
+	// the value it returns is the index of the worker
+	// that accepts the connection. The program is the
+	// kernel's `struct sock_filter` instructions, 8 bytes
+	// each in host byte order, it is only supported on
+	// Linux and the kernel falls back to hashing if it
+	// returns an index without a worker
+	ReuseportBPF []byte
+
+	// ReuseAddr decides if SO_REUSEADDR is set on
+	// each worker socket, defaults to true. It can be
+	// disabled where binding to a port still held by
+	// connections in TIME_WAIT isn't wanted
+	ReuseAddr *bool
+
+	// SocketName is the name given to the file of each
+	// worker socket, it's combined with the BindAddr and
+	// worker index (i.e. "api[127.0.0.1:443#0]") so the
+	// sockets of multiple listeners can be told apart in
+	// diagnostics, defaults to "tls-Protocol-listener"
+	SocketName string
+
+	// PerWorkerControl, if set, is called with the index
+	// of each worker and its socket before the socket is
+	// bound, so each worker can be configured differently
+	// (i.e. SO_INCOMING_CPU to pin a worker to a CPU).
+	// Returning an error fails Start()
+	PerWorkerControl func(index int, c syscall.RawConn) error
+
+	// OnWorkerExit, if set, is called with the index of
+	// a worker and the error from its socket when the
+	// worker stops accepting connections while the listener
+	// is running (i.e. its socket was closed), so the lost
+	// capacity doesn't go unnoticed. The error is also
+	// reported by Accept()
+	OnWorkerExit func(index int, err error)
+
+	// RespawnWorkers has a worker that stopped accepting
+	// connections while the listener is running rebuild
+	// its socket and start accepting again, the attempts
+	// back off from 100ms and are abandoned after 5, failed
+	// attempts are reported by Errors() and giving up by
+	// Accept(). It has no effect on a listener made by Wrap()
+	RespawnWorkers bool
+
+	// BufferedWrites, if set, is the size of a write buffer
+	// placed around every delivered connection so protocols
+	// writing many small frames make fewer writes, delivered
+	// connections are then a *BufferedConn around the TLS
+	// connection, see BufferedConn for when it's flushed
+	BufferedWrites int
+
+	// SampleConn, if set, is called with each connection
+	// as it's delivered and those it returns true for are
+	// delivered as a *SampledConn that records everything
+	// read and written to SampleWriter, so the payloads
+	// of a fraction of connections can be captured when
+	// troubleshooting a protocol
+	SampleConn func(conn net.Conn) bool
+
+	// SampleWriter receives the records of the
+	// connections sampled by SampleConn, see
+	// SampledConn for the format
+	SampleWriter io.Writer
+
+	// DrainHook, if set, is called with each connection
+	// still queued in a channel when the listener stops,
+	// before the connection is closed, so applications can
+	// send a goodbye message. The hooks run concurrently
+	// and the connections' deadlines are set so no hook
+	// holds up stopping for longer than DrainHookTimeout
+	DrainHook func(conn net.Conn)
+
+	// DrainHookTimeout bounds how long stopping waits
+	// for the DrainHook to finish, defaults to 1 second
+	DrainHookTimeout time.Duration
+
+	// DisableDynamicRecordSizing sets the TLS configuration's
+	// `DynamicRecordSizingDisabled` for every handshake, so TLS
+	// records are always as large as possible which helps the
+	// throughput of protocols doing bulk transfers at the cost
+	// of latency at the start of a connection. The TLSConfig
+	// itself isn't modified, configurations returned by its
+	// `GetConfigForClient` callback aren't affected
+	DisableDynamicRecordSizing bool
+
+	// AccessLog, if set, receives a line for every
+	// connection delivered by the listener detailing
+	// the remote address, negotiated protocol, the
+	// listener it was delivered to and the TLS version.
+	//
+	// Lines are written from a separate go routine and
+	// are dropped if the writer can't keep up.
+	AccessLog io.Writer
+
 	// workers stores the references to the underlying
 	// listen workers that listen for connections from
 	// their socket
@@ -46,264 +411,2093 @@ type Listener struct {
 	// net.Addr struct
 	addr net.Addr
 
+	// wrapped is the listener given to Wrap(), its
+	// single worker accepts from it in place of
+	// binding sockets
+	wrapped net.Listener
+
 	// sockAddr is the parsed BindAddr as
 	// a socket address
 	sockAddr syscall.Sockaddr
 
+	// dualSockAddr and dualAddr are the IPv6 address
+	// bound alongside sockAddr with DualStack, they
+	// are nil if there is no second address
+	dualSockAddr syscall.Sockaddr
+	dualAddr     net.Addr
+
+	// sendBuffer and recvBuffer are the socket
+	// buffer sizes read back from the kernel after
+	// SendBuffer and RecvBuffer were applied
+	sendBuffer int
+	recvBuffer int
+
 	// channels is a map of ALPN Protocol
 	// names to their Protocol channels
 	channels map[string]*Protocol
 
+	// redirects maps the ALPN Protocols of the
+	// Protocol listeners closed via CloseTo() to the
+	// Protocol now receiving their connections, it
+	// is guarded by channelsLock along with channels
+	// and the plaintext and drain listeners
+	redirects    map[string]string
+	channelsLock sync.RWMutex
+
 	// defaultChannel is the channel that receives
 	// connections that don't match any of the explicitly
 	// declared protocols
 	defaultChannel chan net.Conn
 
-	// errors receives errors from listen workers
-	// and is piped out via the default Accept() handle
+	// plaintext is the listener that receives raw
+	// connections whose first bytes don't look like
+	// a TLS ClientHello, it is nil unless requested
+	// via PlaintextListener()
+	plaintext *Protocol
+
+	// drain is the listener that receives all
+	// TLS connections once Drain() has been called,
+	// it is nil unless requested via DrainListener()
+	drain *Protocol
+
+	// draining is set by Drain() and is
+	// guarded by stateLock
+	draining  bool
+	stateLock sync.Mutex
+
+	// middleware is the chain registered via
+	// Use(), it is replaced rather than modified
+	// and is guarded by stateLock
+	middleware []Middleware
+
+	// errors receives every error reported by the
+	// listener and is returned by Errors(), fatal
+	// receives the errors that lose the listener
+	// capacity which are also returned by Accept()
 	errors chan error
-}
+	fatal  chan error
 
-// Start initialises the TLS listener by spawning
-// workers to receive connections and constructs the
-// channels to receive default connections and errors
-func (listener *Listener) Start() error {
-	if listener.Listeners == 0 {
-		listener.Listeners = 1
-	}
+	// stats holds the counters exposed
+	// via Stats()
+	stats stats
 
-	if listener.BufferSize < 1 {
-		listener.BufferSize = 1
-	}
+	// config is the TLS configuration used for
+	// new handshakes once it has been updated at
+	// runtime, it is replaced rather than modified
+	// and is guarded by configLock
+	config     *tls.Config
+	configLock sync.RWMutex
 
-	listener.workers = make([]*worker, listener.Listeners)
-	listener.defaultChannel = make(chan net.Conn, listener.BufferSize)
-	listener.errors = make(chan error, 1)
+	// handshakeConfig is derived from config with
+	// the listener's ClientHello hooks installed
+	handshakeConfig *tls.Config
 
-	for i := range listener.workers {
-		socket, err := listener.buildSocket()
-		if err != nil {
-			listener.Stop()
-			return fmt.Errorf("builder worker socket: %s", err)
-		}
+	// protocolConfigs are derived from handshakeConfig
+	// for the ALPN Protocols that need their own
+	// handshake settings, such as client authentication
+	protocolConfigs map[string]*tls.Config
 
-		listener.workers[i] = &worker{
-			parent: listener,
-			socket: socket,
-		}
+	// ticketKeys are the session ticket keys shared by
+	// every handshake configuration so that tickets stay
+	// valid when the configuration is swapped, they are
+	// generated unless set with SetSessionTicketKeys
+	ticketKeys [][32]byte
 
-		listener.workers[i].start()
-	}
+	// accessLog writes the lines for AccessLog,
+	// it is nil if AccessLog isn't set
+	accessLog *accessLog
 
-	return nil
-}
+	// rejected is the channel returned by Rejected(),
+	// it is nil unless RejectedBuffer is set
+	rejected chan RejectedConn
 
-// Accept will receive connections from the
-// default channel (i.e. connections that didn't
-// match an accepted Protocol), it also receives
-// all worker errors
-func (listener *Listener) Accept() (net.Conn, error) {
-	select {
-	case conn, ok := <-listener.defaultChannel:
-		if !ok {
-			return nil, fmt.Errorf("accept %s %s: use of closed network connection", listener.addr.Network(), listener.addr.String())
-		}
+	// events is the channel returned by Events(),
+	// it is nil until Events() is first called and
+	// is guarded by eventsLock
+	events     chan ConnEvent
+	eventsLock sync.Mutex
 
-		return conn, nil
+	// connsPerIP counts the open connections of
+	// each remote IP address for MaxConnsPerIP
+	connsPerIP ipCounter
 
-	case err := <-listener.errors:
-		return nil, err
-	}
-}
+	// workerGroup tracks the listen go routines
+	// of the workers so done can be closed once
+	// they have all returned
+	workerGroup sync.WaitGroup
 
-// Protocol setups a net.Listener to receive all
-// TLS connections that match the ALPN Protocol
-func (listener *Listener) Protocol(proto string) (net.Listener, error) {
-	if len(listener.workers) > 0 {
-		return nil, fmt.Errorf("protocol listener must be created before starting listener")
-	}
+	// done is closed once the listener has been
+	// stopped and every worker has exited
+	done chan struct{}
 
-	if _, exists := listener.channels[proto]; exists {
-		return nil, fmt.Errorf("protocol listener already declared for proto: %s", proto)
-	}
+	// lastConnID is the ID assigned to the
+	// most recently accepted connection
+	lastConnID atomic.Uint64
 
-	if !listener.protocolConfigured(proto) {
-		return nil, fmt.Errorf("protocol not specified in the TLS configuration: %s", proto)
-	}
+	// stopping is closed when the listener starts
+	// stopping so delivery of connections blocked
+	// waiting for a consumer can be abandoned
+	stopping chan struct{}
 
-	if listener.channels == nil {
-		listener.channels = make(map[string]*Protocol, 0)
+	// handshakes tracks the connectionReceived
+	// go routines, inFlight counts them so it
+	// can be polled by GracefulStop()
+	handshakes sync.WaitGroup
+	inFlight   atomic.Int64
+
+	// overflowBase is the kernel's count of accept
+	// queue overflows when the listener started or
+	// its stats were last reset
+	overflowBase atomic.Uint64
+
+	// pendingHandshakes counts the accepted
+	// connections that haven't completed the
+	// handshake for MaxPendingHandshakes
+	pendingHandshakes atomic.Int64
+
+	// delivered counts the connections queued in a
+	// channel since the listener started and
+	// lifetimeReached is set once it reaches
+	// MaxLifetimeConns
+	delivered       atomic.Int64
+	lifetimeReached atomic.Bool
+
+	// stopLock is held while the listener is being
+	// stopped so a stop started by MaxLifetimeConns
+	// and Stop() don't both tear the listener down
+	stopLock sync.Mutex
+
+	// handshakeLimiter is the token bucket
+	// for MaxHandshakesPerSecond, it is nil
+	// if there is no limit
+	handshakeLimiter *rateLimiter
+
+	// pending holds the connections that have been
+	// accepted but not yet routed to a channel so
+	// they can be closed when stopping, once
+	// pendingClosed is set no new connections are
+	// tracked, both are guarded by pendingLock
+	pending       map[*Conn]struct{}
+	pendingClosed bool
+	pendingLock   sync.Mutex
+
+	// active holds the connections that have been
+	// delivered and not yet closed, connections
+	// remove themselves when closed so it never
+	// holds more than the open connections,
+	// guarded by activeLock
+	active     map[*Conn]struct{}
+	activeLock sync.Mutex
+
+	// sampleLock is held while a SampledConn
+	// writes its records to SampleWriter
+	sampleLock sync.Mutex
+
+	// clock, if set, replaces the wall clock
+	// for the listener's timing features
+	clock clock
+
+	// forceClosed counts the connections closed
+	// by delivery being abandoned while stopping
+	forceClosed atomic.Int64
+
+	// priorityPassed counts the connections in a row
+	// AcceptPriority() has returned while a lower
+	// priority listener had connections waiting,
+	// guarded by priorityLock
+	priorityPassed int
+	priorityLock   sync.Mutex
+}
+
+// Start initialises the TLS listener by spawning
+// workers to receive connections and constructs the
+// channels to receive default connections and errors,
+// if it fails the Protocol listeners stay registered
+// so it can be retried
+func (listener *Listener) Start() error {
+	if err := listener.start(); err != nil {
+		return err
 	}
 
-	if listener.BufferSize < 1 {
-		listener.BufferSize = 1
+	return listener.Resume()
+}
+
+// StartEphemeral starts the listener like Start() but if
+// the port of `BindAddr` is already in use it retries with
+// a port assigned by the kernel, returning the address
+// the listener is bound to. It suits tests, where fixed
+// ports clash, and running isolated listeners in parallel.
+// `BindAddr` is left as configured so the listener binds
+// its port again if it's started after being stopped
+func (listener *Listener) StartEphemeral() (net.Addr, error) {
+	err := listener.Start()
+	if errors.Is(err, syscall.EADDRINUSE) {
+		host, port, splitErr := net.SplitHostPort(listener.BindAddr)
+		if splitErr != nil || port == "0" {
+			return nil, err
+		}
+
+		bindAddr := listener.BindAddr
+		listener.BindAddr = net.JoinHostPort(host, "0")
+		err = listener.Start()
+		listener.BindAddr = bindAddr
 	}
 
-	listener.channels[proto] = &Protocol{
-		parent:  listener,
-		proto:   proto,
-		channel: make(chan net.Conn, listener.BufferSize),
+	if err != nil {
+		return nil, err
 	}
 
-	return listener.channels[proto], nil
+	return listener.Addr(), nil
 }
 
-// Addr returns the address that the
-// listener will receive connections on
-func (listener *Listener) Addr() net.Addr {
-	return listener.addr
+// StartPaused initialises the TLS listener like Start()
+// and binds the worker sockets, but the workers won't
+// accept any connection until Resume() is called so
+// consumers can be wired up first. Clients connecting
+// in the meantime wait in the socket's backlog
+func (listener *Listener) StartPaused() error {
+	return listener.start()
 }
 
-// Close calls the Stop() functions on
-// the listener
-func (listener *Listener) Close() error {
-	listener.Stop()
+// Pause stops the workers accepting connections
+// without closing their sockets, so under overload
+// clients wait in the sockets' backlogs until Resume()
+// is called instead of being accepted
+func (listener *Listener) Pause() error {
+	if len(listener.workers) == 0 {
+		return fmt.Errorf("listener must be started before pausing")
+	}
+
+	for i := range listener.workers {
+		if err := listener.workers[i].pause(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// Stop will stop all the workers before
-// closing Protocol listener channels and
-// finally closes the default channel
-func (listener *Listener) Stop() {
+// abortStart closes the sockets of a start that failed
+// part way through, unlike Stop() the Protocol listeners
+// are left registered so that Start() can be retried
+func (listener *Listener) abortStart() {
 	for i := range listener.workers {
 		if listener.workers[i] != nil {
-			listener.workers[i].stop()
+			listener.workers[i].socket.Close()
 		}
 	}
 
-	for proto := range listener.channels {
-		listener.channels[proto].Close()
+	if listener.accessLog != nil {
+		listener.accessLog.close()
+		listener.accessLog = nil
 	}
 
-	if len(listener.defaultChannel) == 1 {
-		conn := <-listener.defaultChannel
-		conn.Close()
-	}
-
-	close(listener.defaultChannel)
 	listener.workers = nil
-	listener.channels = nil
 	listener.sockAddr = nil
+	listener.dualSockAddr = nil
 }
 
-// protocolConfigured checks if the provided ALPN Protocol
-// has been specified in the `NextProtos` sections of the
-// TLS configuration
-func (listener *Listener) protocolConfigured(proto string) bool {
-	for i := range listener.TLSConfig.NextProtos {
-		if listener.TLSConfig.NextProtos[i] == proto {
-			return true
-		}
+// Resume starts the workers of a listener started
+// with StartPaused() or paused by Pause() accepting
+// connections, it does nothing for workers that are
+// already accepting
+func (listener *Listener) Resume() error {
+	if len(listener.workers) == 0 {
+		return fmt.Errorf("listener must be started before resuming")
 	}
 
-	return false
+	for i := range listener.workers {
+		listener.workers[i].start()
+	}
+
+	return nil
 }
 
-// connectionReceived is called by works to send
-// connections up to the parent listener for the
-// connection to be sorted into a channel based on
-// the negotiated ALPN Protocol
-func (listener *Listener) connectionReceived(conn net.Conn) {
-	tlsConn := conn.(*tls.Conn)
-	if err := tlsConn.Handshake(); err != nil {
-		tlsConn.Close()
-		return
+// start validates the listener, constructs its
+// channels and binds a socket for each worker
+// without starting the workers
+func (listener *Listener) start() error {
+	if err := listener.validateConfig(); err != nil {
+		return err
 	}
 
-	if proto, ok := listener.channels[tlsConn.ConnectionState().NegotiatedProtocol]; ok && tlsConn.ConnectionState().NegotiatedProtocolIsMutual {
-		proto.channel <- tlsConn
-	} else {
-		listener.defaultChannel <- tlsConn
+	if listener.SendBuffer < 0 {
+		return fmt.Errorf("send buffer size can't be negative: %d", listener.SendBuffer)
 	}
-}
 
-// getSocketAddress will parse the `BindAddr` into
-// a socket address that a socket can be bound to,
-// `BindAddr` is only parsed once and then stored in
-// the listener struct to prevent excess operations
-func (listener *Listener) getSocketAddress() (syscall.Sockaddr, error) {
-	if listener.sockAddr != nil {
-		return listener.sockAddr, nil
+	if listener.RecvBuffer < 0 {
+		return fmt.Errorf("receive buffer size can't be negative: %d", listener.RecvBuffer)
 	}
 
-	host, port, err := net.SplitHostPort(listener.BindAddr)
-	if err != nil {
-		return nil, fmt.Errorf("split listener address to host and port: %s", err)
+	if len(listener.ReuseportBPF)%8 != 0 {
+		return fmt.Errorf("reuseport BPF program must be whole 8 byte instructions: %d bytes", len(listener.ReuseportBPF))
 	}
 
-	portInt, err := strconv.ParseInt(port, 10, 16)
-	if err != nil {
-		return nil, fmt.Errorf("parse listener address port to int: %s", err)
+	if listener.AcceptGoroutines < 0 {
+		return fmt.Errorf("accept go routines can't be negative: %d", listener.AcceptGoroutines)
 	}
 
-	addr, err := net.ResolveIPAddr("ip", host)
-	if err != nil {
-		return nil, fmt.Errorf("resolove listener address: %s", err)
+	if listener.Listeners == 0 {
+		listener.Listeners = 1
 	}
 
-	switch len(addr.IP) {
-	case net.IPv4len:
-		ip := [4]byte{}
-		copy(ip[:], addr.IP)
-		listener.sockAddr = &syscall.SockaddrInet4{Addr: ip, Port: int(portInt)}
+	if listener.AcceptGoroutines == 0 {
+		listener.AcceptGoroutines = 1
+	}
 
-	case net.IPv6len:
-		ip := [16]byte{}
-		copy(ip[:], addr.IP)
-		listener.sockAddr = &syscall.SockaddrInet6{Addr: ip, Port: int(portInt)}
+	if listener.BufferSize < 1 {
+		listener.BufferSize = 1
+	}
 
-	default:
-		return nil, fmt.Errorf("invalid IP address length: %d", len(addr.IP))
+	listener.prepareConfig()
+
+	if listener.AccessLog != nil {
+		listener.accessLog = newAccessLog(listener.AccessLog)
 	}
 
-	listener.addr = &net.TCPAddr{IP: addr.IP, Zone: addr.Zone, Port: int(portInt)}
-	return listener.sockAddr, nil
-}
+	listener.done = make(chan struct{})
+	listener.stopping = make(chan struct{})
+	listener.pending = make(map[*Conn]struct{})
+	listener.pendingClosed = false
+	workers := listener.Listeners
+	if listener.DualStack && listener.wrapped == nil {
+		if _, err := listener.getSocketAddress(); err != nil {
+			listener.abortStart()
+			return fmt.Errorf("get socket address for bind: %s", err)
+		}
 
-// buildSocket opens a socket in the kernel,
-// sets the socket options to allow multiple binds,
-// binds the socket and finally starts it listening
-func (listener *Listener) buildSocket() (net.Listener, error) {
-	socketAddress, err := listener.getSocketAddress()
-	if err != nil {
-		return nil, fmt.Errorf("get socket address for bind: %s", err)
+		if listener.dualSockAddr != nil {
+			workers *= 2
+		}
 	}
 
-	inetFamily := syscall.AF_INET
-	if _, ok := socketAddress.(*syscall.SockaddrInet6); ok {
-		inetFamily = syscall.AF_INET6
+	listener.workers = make([]*worker, workers)
+	listener.defaultChannel = make(chan net.Conn, listener.BufferSize)
+	listener.errors = make(chan error, errorsBuffer)
+	listener.fatal = make(chan error, errorsBuffer)
+
+	if overflows, ok := listenOverflows(); ok {
+		listener.overflowBase.Store(overflows)
 	}
 
-	fileDescriptor, err := syscall.Socket(inetFamily, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create socket in kernel: %s", err)
+	listener.delivered.Store(0)
+	listener.lifetimeReached.Store(false)
+
+	listener.handshakeLimiter = nil
+	if listener.MaxHandshakesPerSecond > 0 {
+		limit := float64(listener.MaxHandshakesPerSecond)
+		listener.handshakeLimiter = &rateLimiter{rate: limit, burst: limit, tokens: limit}
 	}
-	defer syscall.Close(fileDescriptor)
 
-	if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
-		return nil, fmt.Errorf("failed to set SO_REUSEADDR on socket: %s", err)
+	listener.rejected = nil
+	if listener.RejectedBuffer > 0 {
+		listener.rejected = make(chan RejectedConn, listener.RejectedBuffer)
 	}
 
-	if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_SOCKET, so_reuseport, 1); err != nil {
-		return nil, fmt.Errorf("failed to set SO_REUSEPORT on socket: %s", err)
+	if listener.wrapped != nil {
+		return listener.startWrapped()
 	}
 
-	if err = syscall.SetNonblock(fileDescriptor, true); err != nil {
-		return nil, fmt.Errorf("failed to set non-blocking on socket: %s", err)
+	var bindErrors []error
+	for i := range listener.workers {
+		socket, err := listener.buildSocket(i)
+		if err != nil && !listener.PartialBind {
+			listener.abortStart()
+			return fmt.Errorf("builder worker socket: %w", err)
+		}
+
+		if err != nil {
+			bindErrors = append(bindErrors, fmt.Errorf("builder worker %d socket: %w", i, err))
+			continue
+		}
+
+		listener.workers[i] = &worker{
+			parent: listener,
+			index:  i,
+			socket: socket,
+		}
+	}
+
+	if len(bindErrors) > 0 {
+		return listener.partialStart(bindErrors)
+	}
+
+	return nil
+}
+
+// partialStart drops the workers that failed to bind
+// with PartialBind set and reports their errors, unless
+// no worker bound at all in which case the start fails
+func (listener *Listener) partialStart(bindErrors []error) error {
+	if len(bindErrors) == len(listener.workers) {
+		listener.abortStart()
+		return errors.Join(bindErrors...)
 	}
 
-	if err = syscall.Bind(fileDescriptor, socketAddress); err != nil {
-		return nil, fmt.Errorf("failed to bind socket to address: %s", err)
+	bound := listener.workers[:0]
+	for i := range listener.workers {
+		if listener.workers[i] != nil {
+			bound = append(bound, listener.workers[i])
+		}
 	}
+	listener.workers = bound
 
-	if err = syscall.Listen(fileDescriptor, syscall.SOMAXCONN); err != nil {
-		return nil, fmt.Errorf("failed to start listening for socket: %s", err)
+	for i := range bindErrors {
+		listener.reportFatal(bindErrors[i])
 	}
 
-	socket, err := net.FileListener(os.NewFile(uintptr(fileDescriptor), "tls-Protocol-listener"))
-	if err != nil {
-		return nil, fmt.Errorf("failed to convert file descriptor to listener: %s", err)
+	return nil
+}
+
+// Accept will receive connections from the
+// default channel (i.e. connections that didn't
+// match an accepted Protocol), it also receives
+// the fatal errors, those that lose the listener
+// a worker, see Errors() for every error
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn, ok := <-listener.defaultChannel:
+		if !ok {
+			return nil, fmt.Errorf("accept %s %s: use of closed network connection", listener.addr.Network(), listener.addr.String())
+		}
+
+		return conn, nil
+
+	case err := <-listener.fatal:
+		return nil, err
 	}
+}
 
-	return tls.NewListener(socket, listener.TLSConfig), nil
+// ErrAcceptDone is returned by AcceptOrDone()
+// when its done channel is closed
+var ErrAcceptDone = errors.New("accept cancelled by done channel")
+
+// AcceptOrDone is Accept() that also returns
+// ErrAcceptDone once the done channel is closed,
+// for code that cancels with a channel rather
+// than a context
+func (listener *Listener) AcceptOrDone(done <-chan struct{}) (net.Conn, error) {
+	select {
+	case conn, ok := <-listener.defaultChannel:
+		if !ok {
+			return nil, fmt.Errorf("accept %s %s: use of closed network connection", listener.addr.Network(), listener.addr.String())
+		}
+
+		return conn, nil
+
+	case err := <-listener.fatal:
+		return nil, err
+
+	case <-done:
+		return nil, ErrAcceptDone
+	}
+}
+
+// Errors returns the channel receiving every error
+// reported by the listener, such as connections rejected
+// for exceeding a limit, so they can be consumed apart
+// from Accept() without a stream of connections starving
+// them. Errors are dropped, oldest first, when the channel
+// is full and a new channel is created by each call to
+// Start()
+func (listener *Listener) Errors() <-chan error {
+	return listener.errors
+}
+
+// AcceptFrom is Accept() also returning the index of
+// the worker that accepted the connection, so how the
+// kernel spreads connections across the sockets can be
+// observed. The index is -1 if it isn't known
+func (listener *Listener) AcceptFrom() (net.Conn, int, error) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, -1, err
+	}
+
+	if tracked, ok := ConnFrom(conn); ok {
+		return conn, tracked.Worker(), nil
+	}
+
+	return conn, -1, nil
+}
+
+// AcceptTLS is Accept() returning the TLS connection,
+// a connection wrapped by middleware is unwrapped to its
+// *tls.Conn through `NetConn()`, like ConnFrom, so reads and
+// writes on it bypass the wrapper. If there is no TLS
+// connection (i.e. a plaintext connection) it's closed
+// and an error is returned
+func (listener *Listener) AcceptTLS() (*tls.Conn, error) {
+	return acceptTLS(listener)
+}
+
+// WaitForConnection blocks until a connection is
+// delivered to any of the listener's channels, or the
+// context is done, and returns it with the name of the
+// listener it was delivered to, the ALPN Protocol or
+// "default", "plaintext" or "drain". It competes with
+// the consumers of the channels so it's intended for
+// checking a newly started listener works
+func (listener *Listener) WaitForConnection(ctx context.Context) (net.Conn, string, error) {
+	channels := listener.namedChannels()
+	if channels == nil {
+		return nil, "", fmt.Errorf("listener must be started before waiting for a connection")
+	}
+
+	names := make([]string, 0, len(channels))
+	cases := make([]reflect.SelectCase, 0, len(channels)+1)
+	for name, channel := range channels {
+		names = append(names, name)
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(channel)})
+	}
+
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+
+	chosen, value, ok := reflect.Select(cases)
+	if chosen == len(names) {
+		return nil, "", ctx.Err()
+	}
+
+	if !ok {
+		return nil, "", fmt.Errorf("wait for connection %s %s: use of closed network connection", listener.addr.Network(), listener.addr.String())
+	}
+
+	return value.Interface().(net.Conn), names[chosen], nil
+}
+
+// acceptTLS accepts a connection from the
+// listener and returns it as a TLS connection
+func acceptTLS(listener net.Listener) (*tls.Conn, error) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn, ok := tlsConnFrom(conn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("connection from %s is not a TLS connection: %T", conn.RemoteAddr(), conn)
+	}
+
+	return tlsConn, nil
+}
+
+// Protocol setups a net.Listener to receive all
+// TLS connections that match the ALPN Protocol
+func (listener *Listener) Protocol(proto string) (net.Listener, error) {
+	if len(listener.workers) > 0 {
+		return nil, fmt.Errorf("protocol listener must be created before starting listener")
+	}
+
+	if !listener.protocolConfigured(proto) {
+		return nil, fmt.Errorf("protocol not specified in the TLS configuration: %s", proto)
+	}
+
+	listener.channelsLock.Lock()
+	defer listener.channelsLock.Unlock()
+
+	if _, exists := listener.channels[proto]; exists {
+		return nil, fmt.Errorf("protocol listener already declared for proto: %s", proto)
+	}
+
+	if listener.channels == nil {
+		listener.channels = make(map[string]*Protocol, 0)
+	}
+
+	if listener.BufferSize < 1 {
+		listener.BufferSize = 1
+	}
+
+	listener.channels[proto] = newProtocol(listener, proto, listener.BufferSize)
+	return listener.channels[proto], nil
+}
+
+// ProtocolWithBacklog setups a net.Listener to receive
+// all TLS connections that match the ALPN Protocol, with
+// its own buffer size and overflow policy in place of
+// the listener's BufferSize and OnFull so protocols
+// can tolerate a full queue differently
+func (listener *Listener) ProtocolWithBacklog(proto string, size int, onFull OverflowPolicy) (net.Listener, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("protocol backlog size must be at least 1: %d", size)
+	}
+
+	protocol, err := listener.Protocol(proto)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol.(*Protocol).channel = make(chan net.Conn, size)
+	protocol.(*Protocol).onFull = &onFull
+	return protocol, nil
+}
+
+// ProtocolWithClientAuth setups a net.Listener to receive
+// all TLS connections that match the ALPN Protocol, with
+// the client authentication policy used for handshakes
+// that will negotiate the Protocol.
+//
+// Client authentication is decided from the ClientHello,
+// before ALPN has been negotiated, so the policy applies
+// to handshakes where the Protocol is the first of the
+// TLS configuration's `NextProtos` offered by the client.
+// Certificate authorities still come from the TLS
+// configuration and the policy doesn't apply if its
+// `GetConfigForClient` returns a configuration.
+func (listener *Listener) ProtocolWithClientAuth(proto string, auth tls.ClientAuthType) (net.Listener, error) {
+	protocol, err := listener.Protocol(proto)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol.(*Protocol).clientAuth = &auth
+	return protocol, nil
+}
+
+// ProtocolRequireClientCert setups a net.Listener to
+// receive all TLS connections that match the ALPN Protocol
+// and presented a client certificate that was verified,
+// connections negotiating the Protocol without one are
+// closed and reported by Errors() instead of delivered.
+//
+// Certificates are only verified if the TLS configuration's
+// `ClientAuth` is VerifyClientCertIfGiven or stricter, so
+// mutual TLS can be enforced for one Protocol while it
+// stays optional for the others
+func (listener *Listener) ProtocolRequireClientCert(proto string) (net.Listener, error) {
+	protocol, err := listener.Protocol(proto)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol.(*Protocol).requireClientCert = true
+	return protocol, nil
+}
+
+// ProtocolRejectEarlyData setups a net.Listener to receive
+// all TLS connections that match the ALPN Protocol, where
+// the session tickets issued by handshakes that will
+// negotiate the Protocol can't be used for 0-RTT early
+// data, for protocols where replayed requests are unsafe.
+//
+// Go's crypto/tls servers never accept early data over TCP,
+// the only control it has is the `EarlyData` flag of a
+// tls.SessionState which only QUIC connections honour, so
+// the flag is cleared as tickets are wrapped and resuming
+// with them is a full 1-RTT handshake. Like
+// ProtocolWithClientAuth, it applies when the Protocol is
+// the first of the TLS configuration's `NextProtos`
+// offered by the client.
+func (listener *Listener) ProtocolRejectEarlyData(proto string) (net.Listener, error) {
+	protocol, err := listener.Protocol(proto)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol.(*Protocol).rejectEarlyData = true
+	return protocol, nil
+}
+
+// ProtocolWithHandshakeTimeout setups a net.Listener to
+// receive all TLS connections that match the ALPN Protocol,
+// with a handshake timeout that overrides HandshakeTimeout
+// for handshakes that will negotiate the Protocol.
+//
+// The override can only be applied once the ClientHello
+// has been read, at that point the handshake deadline is
+// replaced with one `timeout` from when the ClientHello
+// was received. Like ProtocolWithClientAuth, it applies
+// when the Protocol is the first of the TLS configuration's
+// `NextProtos` offered by the client.
+func (listener *Listener) ProtocolWithHandshakeTimeout(proto string, timeout time.Duration) (net.Listener, error) {
+	protocol, err := listener.Protocol(proto)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol.(*Protocol).handshakeTimeout = timeout
+	return protocol, nil
+}
+
+// WouldMatch returns the ALPN Protocol of the Protocol
+// listener a client offering the protocols would be routed
+// to, following the same precedence as handshakes. If the
+// client would be routed to the default listener false is
+// returned, draining isn't taken into account
+func (listener *Listener) WouldMatch(offered []string) (string, bool) {
+	proto, selected := listener.selectedProtocol(offered)
+	if !selected {
+		return "", false
+	}
+
+	listener.channelsLock.RLock()
+	defer listener.channelsLock.RUnlock()
+
+	if _, ok := listener.lookupProtocol(proto); !ok {
+		return "", false
+	}
+
+	return proto, true
+}
+
+// PlaintextListener setups a net.Listener to receive
+// all connections that don't start with a TLS ClientHello,
+// these connections are delivered raw without a handshake
+// as a *PrefixConn replaying the peeked bytes to the first
+// reads.
+//
+// If a plaintext listener isn't created, these connections
+// will fail the TLS handshake and be closed.
+func (listener *Listener) PlaintextListener() (net.Listener, error) {
+	if len(listener.workers) > 0 {
+		return nil, fmt.Errorf("plaintext listener must be created before starting listener")
+	}
+
+	if listener.plaintext != nil {
+		return nil, fmt.Errorf("plaintext listener already declared")
+	}
+
+	if listener.BufferSize < 1 {
+		listener.BufferSize = 1
+	}
+
+	listener.plaintext = newProtocol(listener, "", listener.BufferSize)
+
+	return listener.plaintext, nil
+}
+
+// RawListener is equivalent to PlaintextListener, it
+// setups a net.Listener that receives the connections
+// that aren't TLS unwrapped so TLS and non-TLS protocols
+// can be served from the same port
+func (listener *Listener) RawListener() (net.Listener, error) {
+	return listener.PlaintextListener()
+}
+
+// DrainListener setups a net.Listener to receive
+// every TLS connection once Drain() has been called,
+// regardless of the negotiated ALPN Protocol, so a
+// shutdown response can be sent to clients while
+// the listener is being drained
+func (listener *Listener) DrainListener() (net.Listener, error) {
+	if len(listener.workers) > 0 {
+		return nil, fmt.Errorf("drain listener must be created before starting listener")
+	}
+
+	if listener.drain != nil {
+		return nil, fmt.Errorf("drain listener already declared")
+	}
+
+	if listener.BufferSize < 1 {
+		listener.BufferSize = 1
+	}
+
+	listener.drain = newProtocol(listener, "", listener.BufferSize)
+
+	return listener.drain, nil
+}
+
+// Drain switches the listener into drain mode, workers
+// keep accepting and handshaking connections but they
+// are all delivered to the drain listener instead of
+// the default channel or a Protocol listener
+func (listener *Listener) Drain() error {
+	listener.channelsLock.RLock()
+	drain := listener.drain
+	listener.channelsLock.RUnlock()
+
+	if drain == nil {
+		return fmt.Errorf("drain listener must be created before draining listener")
+	}
+
+	listener.stateLock.Lock()
+	defer listener.stateLock.Unlock()
+	listener.draining = true
+
+	return nil
+}
+
+// isDraining will return the value of
+// `draining` of the listener but in a
+// race safe way
+func (listener *Listener) isDraining() bool {
+	listener.stateLock.Lock()
+	defer listener.stateLock.Unlock()
+	return listener.draining
+}
+
+// Stats returns a snapshot of the counters
+// collected from connections handled by the
+// listener
+func (listener *Listener) Stats() Stats {
+	snapshot := listener.stats.snapshot()
+	listener.queueDepths(&snapshot)
+	snapshot.PendingHandshakes = listener.pendingHandshakes.Load()
+	snapshot.HandshakeRate = listener.stats.handshakeRate(listener.getClock().Now())
+	if overflows, ok := listenOverflows(); ok {
+		snapshot.AcceptQueueOverflows = overflows - listener.overflowBase.Load()
+	}
+
+	return snapshot
+}
+
+// ResetStats zeroes the listener's counters and returns
+// their values from before the reset, handshakes completing
+// during the reset are counted in either the returned
+// snapshot or the new counters, never both
+func (listener *Listener) ResetStats() Stats {
+	snapshot := listener.stats.reset()
+	listener.queueDepths(&snapshot)
+	snapshot.PendingHandshakes = listener.pendingHandshakes.Load()
+	snapshot.HandshakeRate = listener.stats.handshakeRate(listener.getClock().Now())
+	if overflows, ok := listenOverflows(); ok {
+		snapshot.AcceptQueueOverflows = overflows - listener.overflowBase.Swap(overflows)
+	}
+
+	return snapshot
+}
+
+// queueDepths fills in the current depth of every
+// channel of the listener, keyed by the same names
+// as the high-water marks
+func (listener *Listener) queueDepths(snapshot *Stats) {
+	for name, channel := range listener.namedChannels() {
+		queue := snapshot.Queues[name]
+		queue.Depth = len(channel)
+		snapshot.Queues[name] = queue
+	}
+}
+
+// namedChannels returns every channel connections are
+// delivered to keyed by the name of its listener, the
+// ALPN Protocol or "default", "plaintext" and "drain"
+func (listener *Listener) namedChannels() map[string]chan net.Conn {
+	if listener.defaultChannel == nil {
+		return nil
+	}
+
+	listener.channelsLock.RLock()
+	plaintext, drain := listener.plaintext, listener.drain
+	listener.channelsLock.RUnlock()
+
+	channels := map[string]chan net.Conn{"default": listener.defaultChannel}
+	for _, protocol := range listener.protocols() {
+		switch {
+		case protocol == plaintext:
+			channels["plaintext"] = protocol.channel
+		case protocol == drain:
+			channels["drain"] = protocol.channel
+		default:
+			channels[protocol.proto] = protocol.channel
+		}
+	}
+
+	return channels
+}
+
+// SocketBuffers returns the send and receive buffer
+// sizes the kernel applied to the worker sockets for
+// SendBuffer and RecvBuffer, a size is 0 if it wasn't
+// configured
+func (listener *Listener) SocketBuffers() (send, recv int) {
+	return listener.sendBuffer, listener.recvBuffer
+}
+
+// Addr returns the address that the
+// listener will receive connections on,
+// it is always the first address of Addrs()
+func (listener *Listener) Addr() net.Addr {
+	return listener.addr
+}
+
+// Addrs returns every address the listener
+// will receive connections on in a stable order,
+// addresses follow the order they were configured
+// and when a hostname resolves to both families
+// the IPv4 address is ordered before the IPv6
+func (listener *Listener) Addrs() []net.Addr {
+	if listener.addr == nil {
+		return nil
+	}
+
+	if listener.dualAddr != nil {
+		return []net.Addr{listener.addr, listener.dualAddr}
+	}
+
+	return []net.Addr{listener.addr}
+}
+
+// Close calls the Stop() functions on
+// the listener
+func (listener *Listener) Close() error {
+	listener.Stop()
+	return nil
+}
+
+// Stop will stop all the workers before
+// closing Protocol listener channels and
+// finally closes the default channel, any
+// connection that hasn't been accepted yet
+// is closed. Stopping a listener that has
+// already stopped does nothing
+func (listener *Listener) Stop() {
+	listener.stop()
+}
+
+// Done returns a channel that is closed once the
+// listener has been stopped, every worker has exited
+// and all the listener's channels have been closed.
+//
+// A new channel is created by each call to Start(),
+// before the first call to Start() it returns nil
+func (listener *Listener) Done() <-chan struct{} {
+	return listener.done
+}
+
+// removeProtocol detaches a Protocol listener from
+// the listener so it no longer receives connections,
+// returning false if it has already been detached
+func (listener *Listener) removeProtocol(protocol *Protocol) bool {
+	listener.channelsLock.Lock()
+	defer listener.channelsLock.Unlock()
+
+	switch {
+	case protocol == listener.plaintext:
+		listener.plaintext = nil
+
+	case protocol == listener.drain:
+		listener.drain = nil
+
+	case listener.channels[protocol.proto] == protocol:
+		delete(listener.channels, protocol.proto)
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+// redirectProtocol detaches a Protocol listener like
+// removeProtocol() but has its connections routed to
+// the target instead, the target is registered as a
+// sender until the queued connections are moved to it
+func (listener *Listener) redirectProtocol(protocol, target *Protocol) error {
+	listener.channelsLock.Lock()
+	defer listener.channelsLock.Unlock()
+
+	if listener.channels[target.proto] != target {
+		return fmt.Errorf("protocol listener isn't attached to the listener: %s", target.proto)
+	}
+
+	if listener.channels[protocol.proto] != protocol {
+		return fmt.Errorf("listener already closed")
+	}
+
+	if listener.redirects == nil {
+		listener.redirects = make(map[string]string)
+	}
+
+	delete(listener.channels, protocol.proto)
+	listener.redirects[protocol.proto] = target.proto
+	target.senders.Add(1)
+
+	return nil
+}
+
+// lookupProtocol returns the Protocol listener receiving
+// the connections of the ALPN Protocol, following the
+// redirects of Protocols closed via CloseTo(), the
+// caller must hold channelsLock
+func (listener *Listener) lookupProtocol(proto string) (*Protocol, bool) {
+	protocol, ok := listener.channels[proto]
+	for hops := 0; !ok && hops < len(listener.redirects); hops++ {
+		target, redirected := listener.redirects[proto]
+		if !redirected {
+			break
+		}
+
+		proto = target
+		protocol, ok = listener.channels[proto]
+	}
+
+	return protocol, ok
+}
+
+// routeProtocol asks the Dispatcher where the connection
+// should be delivered and returns the target and its
+// Protocol listener, see routeTo()
+func (listener *Listener) routeProtocol(conn *tls.Conn, state tls.ConnectionState) (string, *Protocol, bool) {
+	target, ok := listener.dispatcher().Dispatch(conn, state)
+	if !ok {
+		return "", nil, false
+	}
+
+	protocol, ok := listener.routeTo(target)
+	return target, protocol, ok
+}
+
+// hasPlaintext reports if a plaintext
+// listener is attached to the listener
+func (listener *Listener) hasPlaintext() bool {
+	listener.channelsLock.RLock()
+	defer listener.channelsLock.RUnlock()
+	return listener.plaintext != nil
+}
+
+// acquireProtocol returns the plaintext or drain Protocol
+// listener held by `slot`, registered as a sender like
+// routeTo(), it's false if the listener has been closed
+func (listener *Listener) acquireProtocol(slot **Protocol) (*Protocol, bool) {
+	listener.channelsLock.RLock()
+	defer listener.channelsLock.RUnlock()
+
+	protocol := *slot
+	if protocol == nil {
+		return nil, false
+	}
+
+	protocol.senders.Add(1)
+	return protocol, true
+}
+
+// drainingTo returns the drain Protocol listener,
+// registered as a sender, if the listener is
+// draining and the drain listener is open
+func (listener *Listener) drainingTo() (*Protocol, bool) {
+	if !listener.isDraining() {
+		return nil, false
+	}
+
+	return listener.acquireProtocol(&listener.drain)
+}
+
+// routeTo returns the Protocol listener receiving the
+// connections of the target ALPN Protocol, it's registered
+// as a sender of the Protocol so the caller must call
+// `senders.Done()` once it's finished delivering
+func (listener *Listener) routeTo(target string) (*Protocol, bool) {
+	listener.channelsLock.RLock()
+	defer listener.channelsLock.RUnlock()
+
+	protocol, ok := listener.lookupProtocol(target)
+	if ok {
+		protocol.senders.Add(1)
+	}
+
+	return protocol, ok
+}
+
+// protocolConfigured checks if the provided ALPN Protocol
+// has been specified in the `NextProtos` sections of the
+// TLS configuration
+func (listener *Listener) protocolConfigured(proto string) bool {
+	listener.configLock.RLock()
+	defer listener.configLock.RUnlock()
+
+	config := listener.config
+	if config == nil {
+		config = listener.TLSConfig
+	}
+
+	if config == nil {
+		return false
+	}
+
+	for i := range config.NextProtos {
+		if config.NextProtos[i] == proto {
+			return true
+		}
+	}
+
+	return false
+}
+
+// connectionReceived is called by works to send
+// connections up to the parent listener for the
+// connection to be sorted into a channel based on
+// the negotiated ALPN Protocol, `workerIndex` is the
+// index of the worker that accepted the connection
+func (listener *Listener) connectionReceived(rawConn net.Conn, workerIndex int) {
+	defer listener.handshakes.Done()
+	defer listener.inFlight.Add(-1)
+
+	handshaking := true
+	handshakeDone := func() {
+		if handshaking {
+			handshaking = false
+			listener.pendingHandshakes.Add(-1)
+		}
+	}
+	defer handshakeDone()
+
+	tracked, ok := listener.trackConnection(rawConn, workerIndex)
+	if !ok {
+		return
+	}
+
+	var handshakeDeadline time.Time
+	if listener.HandshakeTimeout > 0 {
+		handshakeDeadline = time.Now().Add(listener.HandshakeTimeout)
+		tracked.SetDeadline(handshakeDeadline)
+	}
+
+	if !listener.filterConnection(tracked) {
+		listener.reject(tracked, tracked, ConnRejected, fmt.Errorf("rejected by an accept filter"))
+		listener.connectionEvent(tracked, tracked, "", tls.ConnectionState{}, ConnRejected)
+		return
+	}
+
+	var conn net.Conn = tracked
+	if listener.hasPlaintext() {
+		replay, isTLS, err := peekClientHello(conn, listener.PeekTimeout, handshakeDeadline)
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		if !isTLS {
+			tracked.SetDeadline(time.Time{})
+			tracked.records = nil
+			handshakeDone()
+			listener.untrackPending(tracked)
+			if plaintext, ok := listener.acquireProtocol(&listener.plaintext); ok {
+				listener.deliverToListener("plaintext", plaintext, replay, tls.ConnectionState{})
+			} else {
+				replay.Close()
+			}
+
+			return
+		}
+
+		conn = replay
+	}
+
+	now := listener.getClock().Now()
+	if listener.handshakeLimiter != nil && !listener.handshakeLimiter.allow(now) {
+		listener.stats.handshakeShed()
+		listener.reject(tracked, tracked, ConnLimited, fmt.Errorf("over the limit of %d handshakes per second", listener.MaxHandshakesPerSecond))
+		listener.connectionEvent(tracked, tracked, "", tls.ConnectionState{}, ConnLimited)
+		return
+	}
+
+	listener.stats.handshakeStarted(now)
+
+	var hello *helloConn
+	if listener.MaxClientHelloSize > 0 || listener.OnClientHelloBytes != nil {
+		hello = &helloConn{Conn: conn, limit: listener.MaxClientHelloSize, capture: listener.OnClientHelloBytes != nil}
+		conn = hello
+	}
+
+	tlsConn := tls.Server(conn, listener.serverConfig())
+	handshakeStart := listener.getClock().Now()
+	if err := tlsConn.Handshake(); err != nil {
+		listener.stats.handshakeFailed()
+		listener.reject(tracked, tracked, ConnHandshakeFailed, err)
+		tracked.handshake = listener.getClock().Now().Sub(handshakeStart)
+		listener.connectionEvent(tracked, tracked, "", tls.ConnectionState{}, ConnHandshakeFailed)
+		if hello != nil && hello.exceeded {
+			listener.reportError(fmt.Errorf("connection from %s rejected: ClientHello exceeds %d bytes", tracked.RemoteAddr(), listener.MaxClientHelloSize))
+		}
+
+		return
+	}
+
+	tracked.SetDeadline(time.Time{})
+
+	handshakeDone()
+	listener.untrackPending(tracked)
+
+	state := tlsConn.ConnectionState()
+	tracked.handshakeCompletedAt = listener.getClock().Now()
+	tracked.handshake = tracked.handshakeCompletedAt.Sub(handshakeStart)
+	listener.stats.handshakeCompleted(state, tracked.handshake)
+	if tracked.label != "" {
+		listener.stats.connectionLabelled(tracked.label)
+	}
+
+	listener.route(tlsConn, tracked, state)
+}
+
+// route delivers a connection that completed its
+// handshake to the drain listener while draining,
+// otherwise to the Protocol listener chosen by the
+// Dispatcher or the default listener
+func (listener *Listener) route(tlsConn *tls.Conn, tracked *Conn, state tls.ConnectionState) {
+	if drain, ok := listener.drainingTo(); ok {
+		listener.deliverToListener("drain", drain, tlsConn, state)
+	} else if target, proto, ok := listener.routeProtocol(tlsConn, state); ok {
+		if proto.requireClientCert && len(state.VerifiedChains) == 0 {
+			proto.senders.Done()
+			listener.reject(tlsConn, tracked, ConnRejected, fmt.Errorf("%s listener requires a verified client certificate", proto.proto))
+			listener.connectionEvent(tlsConn, tracked, proto.proto, state, ConnRejected)
+			listener.reportError(fmt.Errorf("connection from %s rejected: %s listener requires a verified client certificate", tracked.RemoteAddr(), proto.proto))
+			return
+		}
+
+		listener.deliverToProtocol(target, proto, tlsConn, state)
+	} else {
+		listener.deliver("default", listener.defaultChannel, tlsConn, state)
+	}
+}
+
+// reportError queues an error to be returned by
+// Errors(), if the queue is full the oldest error
+// is dropped so a worker never blocks reporting it
+func (listener *Listener) reportError(err error) {
+	queueError(listener.errors, err)
+}
+
+// reportFatal queues an error that lost the listener
+// a worker to be returned by both Accept() and Errors()
+func (listener *Listener) reportFatal(err error) {
+	queueError(listener.errors, err)
+	queueError(listener.fatal, err)
+}
+
+// queueError queues the error in the channel, if
+// the channel is full the oldest error is dropped
+func queueError(channel chan error, err error) {
+	for {
+		select {
+		case channel <- err:
+			return
+
+		default:
+		}
+
+		select {
+		case <-channel:
+		default:
+		}
+	}
+}
+
+// connectionAccepted is called by workers for each
+// accepted connection before handing it to its own
+// connectionReceived go routine, it returns false if
+// the connection would exceed MaxPendingHandshakes
+func (listener *Listener) connectionAccepted() bool {
+	pending := listener.pendingHandshakes.Add(1)
+	if listener.MaxPendingHandshakes > 0 && pending > int64(listener.MaxPendingHandshakes) {
+		listener.pendingHandshakes.Add(-1)
+		return false
+	}
+
+	listener.handshakes.Add(1)
+	listener.inFlight.Add(1)
+	return true
+}
+
+// trackConnection wraps the raw connection accepted
+// by a worker so it can be tracked until it's closed,
+// returning false if the connection has been rejected
+func (listener *Listener) trackConnection(rawConn net.Conn, workerIndex int) (*Conn, bool) {
+	conn := newConn(rawConn, listener.lastConnID.Add(1), workerIndex)
+	conn.clock = listener.getClock()
+	conn.acceptedAt = conn.clock.Now()
+	listener.watchRenegotiation(conn)
+
+	if listener.MaxConnsPerIP > 0 {
+		ip := remoteIP(rawConn)
+		if !listener.connsPerIP.acquire(ip, listener.MaxConnsPerIP) {
+			listener.reject(conn, nil, ConnLimited, fmt.Errorf("remote IP is over the limit of %d connections", listener.MaxConnsPerIP))
+			listener.connectionEvent(conn, conn, "", tls.ConnectionState{}, ConnLimited)
+			return nil, false
+		}
+
+		conn.addOnClose(func() {
+			listener.connsPerIP.release(ip)
+		})
+	}
+
+	conn.addOnClose(func() {
+		listener.untrackPending(conn)
+		listener.untrackActive(conn)
+	})
+
+	listener.pendingLock.Lock()
+	closed := listener.pendingClosed
+	if !closed {
+		listener.pending[conn] = struct{}{}
+	}
+	listener.pendingLock.Unlock()
+
+	if closed {
+		conn.Close()
+		return nil, false
+	}
+
+	return conn, true
+}
+
+// untrackPending removes the connection from the
+// connections waiting to be routed to a channel
+func (listener *Listener) untrackPending(conn *Conn) {
+	listener.pendingLock.Lock()
+	defer listener.pendingLock.Unlock()
+	delete(listener.pending, conn)
+}
+
+// trackActive records a connection being delivered,
+// it's only called before the connection is queued
+// so it can't have been closed by a consumer yet
+func (listener *Listener) trackActive(conn *Conn, proto string) {
+	listener.activeLock.Lock()
+	defer listener.activeLock.Unlock()
+
+	conn.proto = proto
+	if listener.active == nil {
+		listener.active = make(map[*Conn]struct{})
+	}
+
+	listener.active[conn] = struct{}{}
+}
+
+// untrackActive removes the connection
+// from the delivered connections
+func (listener *Listener) untrackActive(conn *Conn) {
+	listener.activeLock.Lock()
+	defer listener.activeLock.Unlock()
+	delete(listener.active, conn)
+}
+
+// CloseConns closes every delivered connection that
+// is still open and matches the filter, a nil filter
+// matches all connections, and returns the number of
+// connections closed.
+//
+// It is intended for administrative actions, such as
+// closing all connections from an IP address or for an
+// ALPN Protocol, without restarting the listener.
+func (listener *Listener) CloseConns(filter func(conn *Conn) bool) int {
+	listener.activeLock.Lock()
+	matched := make([]*Conn, 0, len(listener.active))
+	for conn := range listener.active {
+		if filter == nil || filter(conn) {
+			matched = append(matched, conn)
+		}
+	}
+	listener.activeLock.Unlock()
+
+	for i := range matched {
+		matched[i].Close()
+	}
+
+	return len(matched)
+}
+
+// CloseConn closes a single connection delivered by the
+// listener, such as one from a client found to misbehave,
+// without iterating every connection like CloseConns().
+// The connection is closed through `conn` so a TLS
+// connection sends its close_notify alert and buffered
+// writes are flushed. An error is returned if it isn't
+// one of the listener's open delivered connections
+func (listener *Listener) CloseConn(conn net.Conn) error {
+	if err := listener.checkDelivered(conn); err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// CloseConnWith closes a single delivered connection like
+// CloseConn() but first writes `goodbye` to it, if set, and
+// then lingers until the client closes its side so the
+// goodbye isn't lost to the connection being reset while
+// the client's data is still unread. The connection's write
+// side is shut (i.e. a TLS connection sends its close_notify
+// alert) and anything the client sends is discarded.
+//
+// Writing the goodbye and lingering take at most `linger`
+// in total, the connection is closed once it elapses
+func (listener *Listener) CloseConnWith(conn net.Conn, goodbye []byte, linger time.Duration) error {
+	if linger <= 0 {
+		return fmt.Errorf("linger must be positive: %s", linger)
+	}
+
+	if err := listener.checkDelivered(conn); err != nil {
+		return err
+	}
+
+	// the deadline is from the wall clock as the
+	// runtime compares socket deadlines against it
+	conn.SetDeadline(time.Now().Add(linger))
+
+	if len(goodbye) > 0 {
+		if _, err := conn.Write(goodbye); err != nil {
+			conn.Close()
+			return fmt.Errorf("write goodbye: %w", err)
+		}
+	}
+
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok && closer.CloseWrite() == nil {
+		io.Copy(io.Discard, conn)
+	}
+
+	return conn.Close()
+}
+
+// checkDelivered returns an error if the connection
+// isn't one of the listener's open delivered connections
+func (listener *Listener) checkDelivered(conn net.Conn) error {
+	tracked, ok := ConnFrom(conn)
+	if !ok {
+		return fmt.Errorf("connection was not delivered by the listener: %T", conn)
+	}
+
+	listener.activeLock.Lock()
+	_, ok = listener.active[tracked]
+	listener.activeLock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("connection %d is not open or was not delivered by the listener", tracked.ID())
+	}
+
+	return nil
+}
+
+// deliver passes the connection through the middleware
+// chain and queues it in the channel of the named listener
+// following the listener's OnFull policy when the channel
+// is full
+func (listener *Listener) deliver(name string, channel chan net.Conn, conn net.Conn, state tls.ConnectionState) {
+	listener.deliverWithPolicy(listener.OnFull, name, channel, conn, state)
+}
+
+// deliverWithPolicy is deliver() following the
+// `onFull` policy when the channel is full
+func (listener *Listener) deliverWithPolicy(onFull OverflowPolicy, name string, channel chan net.Conn, conn net.Conn, state tls.ConnectionState) {
+	conn, tracked, ok := listener.prepareDelivery(name, conn, state)
+	if !ok {
+		return
+	}
+
+	listener.enqueue(onFull, name, channel, nil, conn, tracked, state)
+}
+
+// deliverToProtocol is deliverWithPolicy() for a Protocol
+// listener returned by routeProtocol(), if the Protocol is
+// closed while waiting for room in its channel the connection
+// is routed to the target again so it isn't lost
+func (listener *Listener) deliverToProtocol(target string, protocol *Protocol, conn net.Conn, state tls.ConnectionState) {
+	conn, tracked, ok := listener.prepareProtocolDelivery(protocol.proto, protocol, conn, state)
+	if !ok {
+		return
+	}
+
+	for {
+		queued := listener.enqueue(protocol.overflowPolicy(), protocol.proto, protocol.channel, protocol.closing, conn, tracked, state)
+		protocol.senders.Done()
+
+		if queued {
+			return
+		}
+
+		if protocol, ok = listener.routeTo(target); !ok {
+			listener.enqueue(listener.OnFull, "default", listener.defaultChannel, nil, conn, tracked, state)
+			return
+		}
+	}
+}
+
+// deliverToListener delivers the connection to the named
+// plaintext or drain Protocol listener, the caller must
+// have registered as a sender with acquireProtocol(). There
+// is no other listener to hand the connection to, so it's
+// dropped if the Protocol listener closes during delivery
+func (listener *Listener) deliverToListener(name string, protocol *Protocol, conn net.Conn, state tls.ConnectionState) {
+	conn, tracked, ok := listener.prepareProtocolDelivery(name, protocol, conn, state)
+	if !ok {
+		return
+	}
+
+	queued := listener.enqueue(protocol.overflowPolicy(), name, protocol.channel, protocol.closing, conn, tracked, state)
+	protocol.senders.Done()
+
+	if !queued {
+		listener.connectionDropped(conn, tracked, name, state)
+	}
+}
+
+// prepareProtocolDelivery is prepareDelivery() followed
+// by the Protocol's middleware chain, the caller's
+// registration as a sender of the Protocol is released
+// if the connection is rejected
+func (listener *Listener) prepareProtocolDelivery(name string, protocol *Protocol, conn net.Conn, state tls.ConnectionState) (net.Conn, *Conn, bool) {
+	conn, tracked, ok := listener.prepareDelivery(name, conn, state)
+	if !ok {
+		protocol.senders.Done()
+		return nil, tracked, false
+	}
+
+	wrapped, err := protocol.applyMiddleware(conn)
+	if err != nil {
+		protocol.senders.Done()
+		listener.reject(conn, tracked, ConnRejected, err)
+		listener.connectionEvent(conn, tracked, name, state, ConnRejected)
+		return nil, tracked, false
+	}
+
+	return wrapped, tracked, true
+}
+
+// prepareDelivery marks the connection as delivered and
+// passes it through SampleConn, BufferedWrites and the
+// middleware chain, if the middleware rejects the
+// connection it's closed and false is returned
+func (listener *Listener) prepareDelivery(name string, conn net.Conn, state tls.ConnectionState) (net.Conn, *Conn, bool) {
+	tracked, ok := ConnFrom(conn)
+	if ok {
+		if listener.MaxConnLifetime > 0 {
+			listener.limitLifetime(tracked)
+		}
+
+		if listener.IdleTimeout > 0 {
+			listener.limitIdle(tracked)
+		}
+
+		listener.trackActive(tracked, state.NegotiatedProtocol)
+	}
+
+	conn = listener.sampleConn(conn, tracked)
+
+	if listener.BufferedWrites > 0 {
+		conn = newBufferedConn(conn, listener.BufferedWrites)
+	}
+
+	wrapped, err := listener.applyMiddleware(conn)
+	if err != nil {
+		listener.reject(conn, tracked, ConnRejected, err)
+		listener.connectionEvent(conn, tracked, name, state, ConnRejected)
+		return nil, tracked, false
+	}
+
+	return wrapped, tracked, true
+}
+
+// limitLifetime has the connection closed once it
+// has been open for MaxConnLifetime, the timer is
+// stopped if the connection is closed first
+func (listener *Listener) limitLifetime(conn *Conn) {
+	timer := listener.getClock().AfterFunc(listener.MaxConnLifetime, func() {
+		conn.Close()
+	})
+
+	context.AfterFunc(conn.Context(), func() {
+		timer.Stop()
+	})
+}
+
+// limitIdle has the connection closed once it has
+// gone IdleTimeout without a read or write, the timer
+// is rearmed for the rest of the timeout when it fires
+// after activity and is stopped if the connection is
+// closed first
+func (listener *Listener) limitIdle(conn *Conn) {
+	clock := listener.getClock()
+	timeout := listener.IdleTimeout
+	conn.idleTimeout = timeout
+	conn.lastActive.Store(clock.Now().UnixNano())
+
+	var timerLock sync.Mutex
+	timerLock.Lock()
+	defer timerLock.Unlock()
+
+	var timer clockTimer
+	timer = clock.AfterFunc(timeout, func() {
+		timerLock.Lock()
+		defer timerLock.Unlock()
+
+		idle := clock.Now().Sub(time.Unix(0, conn.lastActive.Load()))
+		if idle < timeout {
+			timer.Reset(timeout - idle)
+			return
+		}
+
+		conn.Close()
+	})
+
+	context.AfterFunc(conn.Context(), func() {
+		timer.Stop()
+	})
+}
+
+// enqueue queues the connection in the channel of the
+// named listener following the `onFull` policy, it returns
+// false without queueing the connection only if `closing`
+// is closed while waiting for room in the channel
+func (listener *Listener) enqueue(onFull OverflowPolicy, name string, channel chan net.Conn, closing <-chan struct{}, conn net.Conn, tracked *Conn, state tls.ConnectionState) bool {
+	switch onFull {
+	case OverflowDropNewest, OverflowReject:
+		select {
+		case channel <- conn:
+			listener.connectionQueued(channel, conn, tracked, name, state)
+			return true
+
+		default:
+		}
+
+		listener.connectionDropped(conn, tracked, name, state)
+		if onFull == OverflowReject {
+			listener.reportError(fmt.Errorf("connection from %s rejected: %s listener queue is full", conn.RemoteAddr(), name))
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case channel <- conn:
+				listener.connectionQueued(channel, conn, tracked, name, state)
+				return true
+
+			default:
+			}
+
+			select {
+			case oldest := <-channel:
+				listener.queuedConnectionDropped(oldest, name)
+
+			default:
+			}
+		}
+
+	default:
+		select {
+		case channel <- conn:
+			listener.connectionQueued(channel, conn, tracked, name, state)
+
+		case <-listener.stopping:
+			conn.Close()
+			listener.forceClosed.Add(1)
+
+		case <-closing:
+			return false
+		}
+	}
+
+	return true
+}
+
+// connectionQueued records the depth of the channel
+// a connection was queued in, for the high-water mark
+// of the named listener, then logs the connection and
+// emits its ConnEvent, tracked is nil for connections
+// not accepted by a worker
+func (listener *Listener) connectionQueued(channel chan net.Conn, conn net.Conn, tracked *Conn, name string, state tls.ConnectionState) {
+	listener.stats.connectionQueued(name, len(channel))
+
+	if listener.MaxLifetimeConns > 0 && listener.delivered.Add(1) == int64(listener.MaxLifetimeConns) {
+		listener.lifetimeReached.Store(true)
+		go listener.stopAfterLifetimeConns()
+	}
+
+	var id uint64
+	var label string
+	if tracked != nil {
+		id, label = tracked.ID(), tracked.Label()
+	}
+
+	listener.logConnection(conn, id, label, name, state)
+	listener.connectionEvent(conn, tracked, name, state, ConnRouted)
+}
+
+// connectionDropped closes a connection that couldn't
+// be queued in the channel of the named listener,
+// counts it and emits its ConnEvent
+func (listener *Listener) connectionDropped(conn net.Conn, tracked *Conn, name string, state tls.ConnectionState) {
+	conn.Close()
+	listener.stats.connectionDropped()
+	listener.connectionEvent(conn, tracked, name, state, ConnDropped)
+}
+
+// queuedConnectionDropped is connectionDropped() for a
+// connection taken back out of the named listener's
+// channel, its Conn and TLS state are unwrapped from it
+func (listener *Listener) queuedConnectionDropped(conn net.Conn, name string) {
+	var state tls.ConnectionState
+	if tlsConn, ok := tlsConnFrom(conn); ok {
+		state = tlsConn.ConnectionState()
+	}
+
+	tracked, _ := ConnFrom(conn)
+	listener.connectionDropped(conn, tracked, name, state)
+}
+
+// connectionEvent emits the ConnEvent of a connection
+// with the outcome of delivering it to the named listener
+func (listener *Listener) connectionEvent(conn net.Conn, tracked *Conn, name string, state tls.ConnectionState, outcome ConnOutcome) {
+	event := ConnEvent{
+		Time:       listener.getClock().Now(),
+		RemoteAddr: conn.RemoteAddr(),
+		Proto:      state.NegotiatedProtocol,
+		Listener:   name,
+		Outcome:    outcome,
+	}
+
+	if tracked != nil {
+		event.ID, event.HandshakeDuration = tracked.ID(), tracked.handshake
+	}
+
+	listener.emitEvent(event)
+}
+
+// logConnection writes an access log line for
+// a connection being delivered to the named
+// listener if an access log is configured
+func (listener *Listener) logConnection(conn net.Conn, id uint64, label string, name string, state tls.ConnectionState) {
+	if listener.accessLog == nil {
+		return
+	}
+
+	listener.accessLog.log(accessLogEntry{
+		time:       listener.getClock().Now(),
+		id:         id,
+		remoteAddr: conn.RemoteAddr(),
+		proto:      state.NegotiatedProtocol,
+		listener:   name,
+		version:    state.Version,
+		label:      label,
+	})
+}
+
+// getSocketAddress will parse the `BindAddr` into
+// a socket address that a socket can be bound to,
+// `BindAddr` is only parsed once and then stored in
+// the listener struct to prevent excess operations
+func (listener *Listener) getSocketAddress() (syscall.Sockaddr, error) {
+	if listener.sockAddr != nil {
+		return listener.sockAddr, nil
+	}
+
+	if strings.HasPrefix(listener.BindAddr, "@") {
+		return listener.getAbstractSocketAddress()
+	}
+
+	host, port, err := net.SplitHostPort(listener.BindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("split listener address to host and port: %s", err)
+	}
+
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("parse listener address port to int: %s", err)
+	}
+
+	addr, err := listener.resolveHost(host)
+	if err != nil {
+		return nil, fmt.Errorf("resolove listener address: %s", err)
+	}
+
+	// the resolved IP can be in its 16 byte form even for
+	// an IPv4 address, so To4() decides the family to make
+	// sure IPv4 addresses are bound with an AF_INET socket
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		ip := [4]byte{}
+		copy(ip[:], ip4)
+		listener.sockAddr = &syscall.SockaddrInet4{Addr: ip, Port: int(portInt)}
+	} else if ip16 := addr.IP.To16(); ip16 != nil {
+		ip := [16]byte{}
+		copy(ip[:], ip16)
+		listener.sockAddr = &syscall.SockaddrInet6{Addr: ip, Port: int(portInt)}
+	} else {
+		return nil, fmt.Errorf("invalid IP address length: %d", len(addr.IP))
+	}
+
+	listener.addr = &net.TCPAddr{IP: addr.IP, Zone: addr.Zone, Port: int(portInt)}
+
+	listener.dualSockAddr, listener.dualAddr = nil, nil
+	if listener.DualStack && addr.IP.To4() != nil && net.ParseIP(host) == nil {
+		addr6, err := listener.resolveIPv6(host)
+		if err != nil {
+			return nil, fmt.Errorf("resolove listener IPv6 address: %s", err)
+		}
+
+		if addr6 != nil {
+			ip := [16]byte{}
+			copy(ip[:], addr6.IP.To16())
+			listener.dualSockAddr = &syscall.SockaddrInet6{Addr: ip, Port: int(portInt)}
+			listener.dualAddr = &net.TCPAddr{IP: addr6.IP, Zone: addr6.Zone, Port: int(portInt)}
+		}
+	}
+
+	return listener.sockAddr, nil
+}
+
+// resolveHost resolves the host of `BindAddr` with the
+// listener's Resolver, like net.ResolveIPAddr() an IPv4
+// address is preferred when the host has several
+func (listener *Listener) resolveHost(host string) (*net.IPAddr, error) {
+	if listener.Resolver == nil {
+		return net.ResolveIPAddr("ip", host)
+	}
+
+	addrs, err := listener.Resolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range addrs {
+		if addrs[i].IP.To4() != nil {
+			return &addrs[i], nil
+		}
+	}
+
+	return &addrs[0], nil
+}
+
+// resolveIPv6 returns the first IPv6 address the host
+// of `BindAddr` resolves to for DualStack, it is nil
+// if the host has no IPv6 address
+func (listener *Listener) resolveIPv6(host string) (*net.IPAddr, error) {
+	resolver := listener.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	addrs, err := resolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range addrs {
+		if addrs[i].IP.To4() == nil {
+			return &addrs[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// getAbstractSocketAddress parses a `BindAddr` starting
+// with `@` into an abstract Unix socket address, Linux
+// replaces the `@` with the null byte that marks the
+// name as being in the abstract namespace
+func (listener *Listener) getAbstractSocketAddress() (syscall.Sockaddr, error) {
+	if !abstractSocketsSupported {
+		return nil, fmt.Errorf("abstract unix sockets are not supported on this platform")
+	}
+
+	if len(listener.BindAddr) < 2 {
+		return nil, fmt.Errorf("abstract unix socket name is empty")
+	}
+
+	if listener.Listeners > 1 {
+		return nil, fmt.Errorf("abstract unix sockets only support a single listener")
+	}
+
+	listener.sockAddr = &syscall.SockaddrUnix{Name: listener.BindAddr}
+	listener.addr = &net.UnixAddr{Name: listener.BindAddr, Net: "unix"}
+	return listener.sockAddr, nil
+}
+
+// buildSocket opens a socket in the kernel for the
+// worker at `index`, sets the socket options to allow
+// multiple binds, binds the socket and finally starts
+// it listening.
+//
+// The returned listener accepts raw connections, the
+// TLS server side is applied in connectionReceived so
+// the first bytes can be inspected before the handshake
+func (listener *Listener) buildSocket(index int) (net.Listener, error) {
+	socketAddress, err := listener.getSocketAddress()
+	if err != nil {
+		return nil, fmt.Errorf("get socket address for bind: %s", err)
+	}
+
+	// with DualStack the workers after the
+	// first `Listeners` bind the IPv6 address
+	if index >= listener.Listeners && listener.dualSockAddr != nil {
+		socketAddress = listener.dualSockAddr
+	}
+
+	inetFamily, protocol := syscall.AF_INET, syscall.IPPROTO_TCP
+	switch socketAddress.(type) {
+	case *syscall.SockaddrInet6:
+		inetFamily = syscall.AF_INET6
+
+	case *syscall.SockaddrUnix:
+		inetFamily, protocol = syscall.AF_UNIX, 0
+	}
+
+	var fileDescriptor int
+	err = ignoringEINTR(func() (err error) {
+		fileDescriptor, err = syscall.Socket(inetFamily, syscall.SOCK_STREAM, protocol)
+		return err
+	})
+	if err != nil {
+		return nil, &SocketError{Op: "socket", Err: err}
+	}
+
+	// net.FileListener duplicates the descriptor, so the
+	// original is always closed via the os.File to stop its
+	// finalizer from closing a reused descriptor number later
+	socketFile := os.NewFile(uintptr(fileDescriptor), listener.socketFileName(index))
+	defer socketFile.Close()
+
+	if inetFamily != syscall.AF_UNIX {
+		if listener.ReuseAddr == nil || *listener.ReuseAddr {
+			if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+				return nil, &SocketError{Op: "setsockopt", Option: "SO_REUSEADDR", Err: err}
+			}
+		}
+
+		if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_SOCKET, so_reuseport, 1); err != nil {
+			return nil, &SocketError{Op: "setsockopt", Option: "SO_REUSEPORT", Err: err}
+		}
+
+		if index%listener.Listeners == 0 && len(listener.ReuseportBPF) > 0 {
+			if !reuseportBPFSupported {
+				return nil, fmt.Errorf("reuseport BPF programs are not supported on this platform")
+			}
+
+			if err = attachReuseportBPF(fileDescriptor, listener.ReuseportBPF); err != nil {
+				return nil, &SocketError{Op: "setsockopt", Option: "SO_ATTACH_REUSEPORT_CBPF", Err: err}
+			}
+		}
+	}
+
+	if err = listener.setSocketBuffers(fileDescriptor); err != nil {
+		return nil, err
+	}
+
+	if listener.FirewallMark != 0 {
+		if !firewallMarksSupported {
+			return nil, fmt.Errorf("firewall marks are not supported on this platform")
+		}
+
+		if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_SOCKET, so_mark, listener.FirewallMark); err != nil {
+			return nil, &SocketError{Op: "setsockopt", Option: "SO_MARK", Err: err}
+		}
+	}
+
+	if listener.PerWorkerControl != nil {
+		rawConn, err := socketFile.SyscallConn()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get raw socket: %s", err)
+		}
+
+		if err = listener.PerWorkerControl(index, rawConn); err != nil {
+			return nil, fmt.Errorf("worker %d control: %s", index, err)
+		}
+	}
+
+	if err = syscall.SetNonblock(fileDescriptor, true); err != nil {
+		return nil, &SocketError{Op: "setnonblock", Err: err}
+	}
+
+	if err = ignoringEINTR(func() error { return syscall.Bind(fileDescriptor, socketAddress) }); err != nil {
+		return nil, &SocketError{Op: "bind", Err: err}
+	}
+
+	if err = ignoringEINTR(func() error { return syscall.Listen(fileDescriptor, syscall.SOMAXCONN) }); err != nil {
+		return nil, &SocketError{Op: "listen", Err: err}
+	}
+
+	if err = listener.updateBoundPort(fileDescriptor); err != nil {
+		return nil, err
+	}
+
+	socket, err := net.FileListener(socketFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert file descriptor to listener: %s", err)
+	}
+
+	return socket, nil
+}
+
+// ignoringEINTR calls the syscall until it isn't
+// interrupted by a signal, like the Go runtime does
+// for its own syscalls
+func ignoringEINTR(call func() error) error {
+	for {
+		if err := call(); err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// socketFileName returns the name of the
+// file for the socket of the worker at `index`
+func (listener *Listener) socketFileName(index int) string {
+	name := listener.SocketName
+	if name == "" {
+		name = defaultSocketName
+	}
+
+	return fmt.Sprintf("%s[%s#%d]", name, listener.BindAddr, index)
+}
+
+// setSocketBuffers applies SendBuffer and RecvBuffer
+// to the socket before it's bound and records the
+// sizes the kernel settled on
+func (listener *Listener) setSocketBuffers(fileDescriptor int) error {
+	var err error
+
+	if listener.SendBuffer > 0 {
+		if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_SOCKET, syscall.SO_SNDBUF, listener.SendBuffer); err != nil {
+			return &SocketError{Op: "setsockopt", Option: "SO_SNDBUF", Err: err}
+		}
+
+		if listener.sendBuffer, err = syscall.GetsockoptInt(fileDescriptor, syscall.SOL_SOCKET, syscall.SO_SNDBUF); err != nil {
+			return &SocketError{Op: "getsockopt", Option: "SO_SNDBUF", Err: err}
+		}
+	}
+
+	if listener.RecvBuffer > 0 {
+		if err = syscall.SetsockoptInt(fileDescriptor, syscall.SOL_SOCKET, syscall.SO_RCVBUF, listener.RecvBuffer); err != nil {
+			return &SocketError{Op: "setsockopt", Option: "SO_RCVBUF", Err: err}
+		}
+
+		if listener.recvBuffer, err = syscall.GetsockoptInt(fileDescriptor, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err != nil {
+			return &SocketError{Op: "getsockopt", Option: "SO_RCVBUF", Err: err}
+		}
+	}
+
+	return nil
+}
+
+// updateBoundPort reads back the port the kernel
+// bound the socket to when `BindAddr` uses port 0,
+// so Addr() reports the assigned port and the sockets
+// of the remaining workers bind to the same port
+func (listener *Listener) updateBoundPort(fileDescriptor int) error {
+	addr, ok := listener.addr.(*net.TCPAddr)
+	if !ok || addr.Port != 0 {
+		return nil
+	}
+
+	bound, err := syscall.Getsockname(fileDescriptor)
+	if err != nil {
+		return &SocketError{Op: "getsockname", Err: err}
+	}
+
+	var port int
+	switch bound := bound.(type) {
+	case *syscall.SockaddrInet4:
+		port = bound.Port
+
+	case *syscall.SockaddrInet6:
+		port = bound.Port
+
+	default:
+		return fmt.Errorf("unexpected socket address type: %T", bound)
+	}
+
+	for _, sockAddr := range []syscall.Sockaddr{listener.sockAddr, listener.dualSockAddr} {
+		switch sockAddr := sockAddr.(type) {
+		case *syscall.SockaddrInet4:
+			sockAddr.Port = port
+
+		case *syscall.SockaddrInet6:
+			sockAddr.Port = port
+		}
+	}
+
+	listener.addr = &net.TCPAddr{IP: addr.IP, Zone: addr.Zone, Port: port}
+	if dualAddr, ok := listener.dualAddr.(*net.TCPAddr); ok {
+		listener.dualAddr = &net.TCPAddr{IP: dualAddr.IP, Zone: dualAddr.Zone, Port: port}
+	}
+
+	return nil
 }
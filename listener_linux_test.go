@@ -0,0 +1,131 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"syscall"
+)
+
+var _ = Describe("Abstract unix sockets", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "@tlsprotocol-test",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should bind and accept on an abstract namespace socket", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		Expect(listener.Addr().Network()).To(Equal("unix"))
+		Expect(listener.Addr().String()).To(Equal("@tlsprotocol-test"))
+
+		rawConn, err := net.Dial("unix", "@tlsprotocol-test")
+		Expect(err).To(BeNil())
+
+		conn := tls.Client(rawConn, &tls.Config{InsecureSkipVerify: true})
+		defer conn.Close()
+		Expect(conn.Handshake()).To(BeNil())
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+
+	It("Shouldn't allow more than one listener", func() {
+		listener := &Listener{BindAddr: "@tlsprotocol-test", Listeners: 2, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+
+		err := listener.Start()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("abstract unix sockets only support a single listener"))
+	})
+})
+
+var _ = Describe("Firewall marks", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:     "127.0.0.1:6126",
+		FirewallMark: 0x2a,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should mark the worker sockets", func() {
+		err := listener.Start()
+		if errors.Is(err, syscall.EPERM) {
+			Skip("setting SO_MARK needs CAP_NET_ADMIN")
+		}
+
+		Expect(err).To(BeNil())
+		defer listener.Stop()
+
+		rawConn, err := listener.workers[0].socket.(*net.TCPListener).SyscallConn()
+		Expect(err).To(BeNil())
+
+		var mark int
+		Expect(rawConn.Control(func(fd uintptr) {
+			mark, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+		})).To(Succeed())
+		Expect(err).To(BeNil())
+		Expect(mark).To(Equal(0x2a))
+	})
+})
+
+var _ = Describe("Reuseport BPF", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+
+	It("Should reject a program that isn't whole instructions", func() {
+		listener := &Listener{BindAddr: "127.0.0.1:6131", ReuseportBPF: []byte{0x06, 0, 0}, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+		Expect(listener.Start()).To(MatchError("reuseport BPF program must be whole 8 byte instructions: 3 bytes"))
+	})
+
+	It("Should steer connections to the worker the program returns", func() {
+		listener := &Listener{
+			BindAddr:  "127.0.0.1:6131",
+			Listeners: 4,
+			// BPF_RET | BPF_K returning 2
+			ReuseportBPF: []byte{0x06, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00},
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		for i := 0; i < 8; i++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6131", &tls.Config{InsecureSkipVerify: true})
+			Expect(err).To(BeNil())
+
+			serverConn, worker, err := listener.AcceptFrom()
+			Expect(err).To(BeNil())
+			Expect(worker).To(Equal(2))
+
+			serverConn.Close()
+			conn.Close()
+		}
+	})
+})
+
+var _ = Describe("Accept queue overflows", func() {
+	It("Should read the kernel's count of overflows", func() {
+		_, ok := listenOverflows()
+		Expect(ok).To(BeTrue())
+	})
+
+	It("Should count overflows since the listener started", func() {
+		listener := &Listener{}
+		overflows, _ := listenOverflows()
+		listener.overflowBase.Store(overflows - 3)
+
+		Expect(listener.Stats().AcceptQueueOverflows).To(BeNumerically(">=", 3))
+		Expect(listener.ResetStats().AcceptQueueOverflows).To(BeNumerically(">=", 3))
+		Expect(listener.Stats().AcceptQueueOverflows).To(BeNumerically("<", 3))
+	})
+})
@@ -1,3 +1,88 @@
 package tlsprotocol
 
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
 const so_reuseport = 0x0F
+
+// abstractSocketsSupported reports if Unix
+// sockets in the abstract namespace can be bound
+const abstractSocketsSupported = true
+
+// firewallMarksSupported reports if sockets
+// can be given a firewall mark with so_mark
+const firewallMarksSupported = true
+
+const so_mark = 0x24
+
+// reuseportBPFSupported reports if a BPF program
+// can steer connections between reuseport sockets
+const reuseportBPFSupported = true
+
+const so_attach_reuseport_cbpf = 0x33
+
+// attachReuseportBPF attaches the classic BPF
+// program to the socket's reuseport group
+func attachReuseportBPF(fd int, program []byte) error {
+	filter := make([]syscall.SockFilter, len(program)/8)
+	for i := range filter {
+		instruction := program[i*8:]
+		filter[i] = syscall.SockFilter{
+			Code: binary.NativeEndian.Uint16(instruction[0:2]),
+			Jt:   instruction[2],
+			Jf:   instruction[3],
+			K:    binary.NativeEndian.Uint32(instruction[4:8]),
+		}
+	}
+
+	fprog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.SOL_SOCKET, so_attach_reuseport_cbpf, uintptr(unsafe.Pointer(&fprog)), unsafe.Sizeof(fprog), 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// listenOverflows returns the number of connections the
+// kernel dropped as an accept queue was full, it's counted
+// across the network namespace rather than per socket
+func listenOverflows() (uint64, bool) {
+	file, err := os.Open("/proc/net/netstat")
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "TcpExt:" {
+			continue
+		}
+
+		if names == nil {
+			names = fields
+			continue
+		}
+
+		for i := 1; i < len(names) && i < len(fields); i++ {
+			if names[i] == "ListenOverflows" {
+				overflows, err := strconv.ParseUint(fields[i], 10, 64)
+				return overflows, err == nil
+			}
+		}
+
+		return 0, false
+	}
+
+	return 0, false
+}
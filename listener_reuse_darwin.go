@@ -3,3 +3,29 @@ package tlsprotocol
 import "syscall"
 
 const so_reuseport = syscall.SO_REUSEPORT
+
+// abstractSocketsSupported reports if Unix
+// sockets in the abstract namespace can be bound
+const abstractSocketsSupported = false
+
+// firewallMarksSupported reports if sockets
+// can be given a firewall mark with so_mark
+const firewallMarksSupported = false
+
+const so_mark = 0
+
+// reuseportBPFSupported reports if a BPF program
+// can steer connections between reuseport sockets
+const reuseportBPFSupported = false
+
+// attachReuseportBPF is never called
+// as reuseportBPFSupported is false
+func attachReuseportBPF(fd int, program []byte) error {
+	return syscall.ENOPROTOOPT
+}
+
+// listenOverflows isn't supported as the
+// kernel's counters can't be read
+func listenOverflows() (uint64, bool) {
+	return 0, false
+}
@@ -1,11 +1,20 @@
 package tlsprotocol
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -62,6 +71,7 @@ var _ = Describe("Listener", func() {
 		Expect(len(listener.workers)).To(Equal(1))
 
 		Expect(listener.Addr()).To(BeAssignableToTypeOf(&net.TCPAddr{}))
+		Expect(listener.Addrs()).To(Equal([]net.Addr{listener.Addr()}))
 		Expect(listener.Addr().(*net.TCPAddr).Port).To(Equal(6080))
 		Expect(listener.Addr().(*net.TCPAddr).IP).To(Equal(net.IP{
 			0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xFF, 0xFF, 0x7f, 0x0, 0x0, 0x01, // 127.0.0.1 as net.IPv6
@@ -75,14 +85,16 @@ var _ = Describe("Listener", func() {
 			Expect(worker.socket.Addr()).To(BeAssignableToTypeOf(&net.TCPAddr{}))
 			Expect(worker.socket.Addr().(*net.TCPAddr).Port).To(Equal(6080))
 			Expect(worker.socket.Addr().(*net.TCPAddr).IP).To(Equal(net.IP{
-				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xFF, 0xFF, 0x7f, 0x0, 0x0, 0x01, // 127.0.0.1 as net.IPv6
+				0x7f, 0x0, 0x0, 0x01, // 127.0.0.1 bound with an IPv4 socket
 			}))
 		}
 
 		for _, channel := range listener.channels {
-			Expect(channel.Addr()).To(BeAssignableToTypeOf(&net.TCPAddr{}))
-			Expect(channel.Addr().(*net.TCPAddr).Port).To(Equal(6080))
-			Expect(channel.Addr().(*net.TCPAddr).IP).To(Equal(net.IP{
+			Expect(channel.Addr()).To(BeAssignableToTypeOf(&ProtocolAddr{}))
+			Expect(channel.Addr().Network()).To(Equal("tcp"))
+			Expect(channel.Addr().String()).To(Equal("127.0.0.1:6080[h2]"))
+			Expect(channel.Addr().(*ProtocolAddr).Addr.(*net.TCPAddr).Port).To(Equal(6080))
+			Expect(channel.Addr().(*ProtocolAddr).Addr.(*net.TCPAddr).IP).To(Equal(net.IP{
 				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xFF, 0xFF, 0x7f, 0x0, 0x0, 0x01, // 127.0.0.1 as net.IPv6
 			}))
 		}
@@ -117,6 +129,46 @@ var _ = Describe("Listener", func() {
 		Expect(len(listener.channels["h2"].channel)).To(Equal(1))
 	})
 
+	It("Should count the negotiated TLS versions and cipher suites", func() {
+		stats := listener.Stats()
+
+		var versions, cipherSuites uint64
+		for _, count := range stats.Versions {
+			versions += count
+		}
+
+		for _, count := range stats.CipherSuites {
+			cipherSuites += count
+		}
+
+		Expect(versions).To(Equal(uint64(2)))
+		Expect(cipherSuites).To(Equal(uint64(2)))
+	})
+
+	It("Should bucket the durations of the handshakes", func() {
+		var handshakes uint64
+		for _, count := range listener.Stats().HandshakeDurations {
+			handshakes += count
+		}
+
+		Expect(handshakes).To(Equal(uint64(2)))
+
+		var counters stats
+		counters.handshakeCompleted(tls.ConnectionState{}, 5*time.Millisecond)
+		counters.handshakeCompleted(tls.ConnectionState{}, 2*time.Second)
+		Expect(counters.snapshot().HandshakeDurations).To(Equal([5]uint64{0, 1, 0, 0, 1}))
+	})
+
+	It("Should reset the counters and return their previous values", func() {
+		stats := listener.ResetStats()
+		Expect(stats.Versions).ToNot(BeEmpty())
+
+		stats = listener.Stats()
+		Expect(stats.Versions).To(BeEmpty())
+		Expect(stats.CipherSuites).To(BeEmpty())
+		Expect(stats.HandshakeDurations).To(Equal([5]uint64{}))
+	})
+
 	It("Should return connections queued in the default channel", func() {
 		conn, err := listener.Accept()
 		defer conn.Close()
@@ -137,6 +189,7 @@ var _ = Describe("Listener", func() {
 
 	It("Should stop listening sockets and cleanup", func() {
 		listener.Stop()
+		Eventually(listener.Done()).Should(BeClosed())
 		Expect(listener.defaultChannel).To(BeClosed())
 		Expect(listener.sockAddr).To(BeNil())
 		Expect(len(listener.workers)).To(Equal(0))
@@ -156,3 +209,2398 @@ var _ = Describe("Listener", func() {
 		Expect(conn).To(BeNil())
 	})
 })
+
+var _ = Describe("Plaintext listener", func() {
+	var plaintextListener net.Listener
+
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6081",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should configure a plaintext listener", func() {
+		var err error
+		plaintextListener, err = listener.PlaintextListener()
+
+		Expect(err).To(BeNil())
+		Expect(plaintextListener).ToNot(BeNil())
+		Expect(listener.Start()).To(BeNil())
+	})
+
+	It("Should deliver non-TLS connections to the plaintext listener with the first bytes replayed", func() {
+		conn, err := net.Dial("tcp", "127.0.0.1:6081")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		Expect(err).To(BeNil())
+
+		plainConn, err := plaintextListener.Accept()
+		Expect(err).To(BeNil())
+		defer plainConn.Close()
+		Expect(plainConn).To(BeAssignableToTypeOf(&PrefixConn{}))
+
+		buffer := make([]byte, 5)
+		_, err = io.ReadFull(plainConn, buffer)
+		Expect(err).To(BeNil())
+		Expect(string(buffer)).To(Equal("GET /"))
+	})
+
+	It("Should still deliver TLS connections to the default channel", func() {
+		conn, err := tls.Dial("tcp", "127.0.0.1:6081", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		tlsConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		Expect(tlsConn).To(BeAssignableToTypeOf(&tls.Conn{}))
+		tlsConn.Close()
+	})
+
+	It("Should drop connections being delivered when the plaintext listener is closed", func() {
+		queued, err := net.Dial("tcp", "127.0.0.1:6081")
+		Expect(err).To(BeNil())
+		defer queued.Close()
+
+		_, err = queued.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		Expect(err).To(BeNil())
+		Eventually(func() int { return len(plaintextListener.(*Protocol).channel) }).Should(Equal(1))
+
+		blocked, err := net.Dial("tcp", "127.0.0.1:6081")
+		Expect(err).To(BeNil())
+		defer blocked.Close()
+
+		_, err = blocked.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		Expect(err).To(BeNil())
+		Eventually(listener.inFlight.Load).Should(Equal(int64(1)))
+
+		Expect(plaintextListener.Close()).To(Succeed())
+
+		_, err = blocked.Read(make([]byte, 1))
+		Expect(err).ToNot(BeNil())
+		Eventually(listener.inFlight.Load).Should(Equal(int64(0)))
+
+		conn, err := plaintextListener.Accept()
+		Expect(err).To(BeNil())
+		Expect(conn.Close()).To(Succeed())
+	})
+
+	It("Should close the plaintext listener on stop", func() {
+		listener.Stop()
+
+		conn, err := plaintextListener.Accept()
+		Expect(conn).To(BeNil())
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Plaintext handshake timeout", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:         "127.0.0.1:6148",
+		HandshakeTimeout: 50 * time.Millisecond,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should close clients that send nothing before the handshake timeout", func() {
+		_, err := listener.PlaintextListener()
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:6148")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+		Eventually(listener.pendingHandshakes.Load).Should(Equal(int64(0)))
+	})
+})
+
+var _ = Describe("Prefix connections", func() {
+	It("Should replay the prefix across reads before the connection", func() {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		conn := NewPrefixConn(server, []byte("GET"))
+		defer conn.Close()
+
+		go client.Write([]byte(" /"))
+
+		buffer := make([]byte, 2)
+		_, err := io.ReadFull(conn, buffer)
+		Expect(err).To(BeNil())
+		Expect(string(buffer)).To(Equal("GE"))
+
+		buffer = make([]byte, 3)
+		_, err = io.ReadFull(conn, buffer)
+		Expect(err).To(BeNil())
+		Expect(string(buffer)).To(Equal("T /"))
+
+		tracked, ok := ConnFrom(NewPrefixConn(newConn(server, 1, 0), nil))
+		Expect(ok).To(BeTrue())
+		Expect(tracked.ID()).To(Equal(uint64(1)))
+	})
+})
+
+var _ = Describe("Drain listener", func() {
+	var drainListener net.Listener
+
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6086",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Shouldn't allow draining without a drain listener", func() {
+		err := listener.Drain()
+
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal("drain listener must be created before draining listener"))
+	})
+
+	It("Should deliver all TLS connections to the drain listener while draining", func() {
+		var err error
+		drainListener, err = listener.DrainListener()
+		Expect(err).To(BeNil())
+
+		_, err = listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		Expect(listener.Drain()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6086", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		drainConn, err := drainListener.Accept()
+		Expect(err).To(BeNil())
+		Expect(drainConn.(*tls.Conn).ConnectionState().NegotiatedProtocol).To(Equal("h2"))
+		drainConn.Close()
+	})
+
+	It("Should drop connections being delivered when the drain listener is closed", func() {
+		for i := 0; i < 2; i++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6086", &tls.Config{InsecureSkipVerify: true})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+		}
+
+		Eventually(func() int { return len(drainListener.(*Protocol).channel) }).Should(Equal(1))
+		Eventually(listener.inFlight.Load).Should(Equal(int64(1)))
+
+		Expect(drainListener.Close()).To(Succeed())
+		Eventually(listener.inFlight.Load).Should(Equal(int64(0)))
+
+		conn, err := drainListener.Accept()
+		Expect(err).To(BeNil())
+		Expect(conn.Close()).To(Succeed())
+	})
+
+	It("Should close the drain listener on stop", func() {
+		listener.Stop()
+
+		conn, err := drainListener.Accept()
+		Expect(conn).To(BeNil())
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Connections per IP", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:      "127.0.0.1:6087",
+		MaxConnsPerIP: 1,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should reject connections over the limit until a connection is closed", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6087", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+
+		_, err = tls.Dial("tcp", "127.0.0.1:6087", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).ToNot(BeNil())
+
+		serverConn.Close()
+		Eventually(func() int {
+			listener.connsPerIP.lock.Lock()
+			defer listener.connsPerIP.lock.Unlock()
+			return len(listener.connsPerIP.counts)
+		}).Should(Equal(0))
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:6087", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err = listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Error reporting", func() {
+	listener := &Listener{}
+
+	It("Should drop the oldest errors instead of blocking when the queue is full", func() {
+		listener.errors = make(chan error, 2)
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 5; i++ {
+				listener.reportError(fmt.Errorf("error %d", i))
+			}
+			close(done)
+		}()
+
+		Eventually(done).Should(BeClosed())
+		Expect((<-listener.errors).Error()).To(Equal("error 3"))
+		Expect((<-listener.errors).Error()).To(Equal("error 4"))
+	})
+
+	It("Should only return fatal errors from Accept", func() {
+		listener.errors = make(chan error, 2)
+		listener.fatal = make(chan error, 2)
+		listener.defaultChannel = make(chan net.Conn)
+
+		listener.reportError(fmt.Errorf("rejected"))
+		listener.reportFatal(fmt.Errorf("worker exited"))
+
+		_, err := listener.Accept()
+		Expect(err).To(MatchError("worker exited"))
+
+		Expect(listener.Errors()).To(Receive(MatchError("rejected")))
+		Expect(listener.Errors()).To(Receive(MatchError("worker exited")))
+	})
+
+	It("Should stop accepting once the done channel is closed", func() {
+		listener.fatal = make(chan error, 1)
+		listener.defaultChannel = make(chan net.Conn, 1)
+
+		conn, _ := net.Pipe()
+		listener.defaultChannel <- conn
+
+		done := make(chan struct{})
+		accepted, err := listener.AcceptOrDone(done)
+		Expect(err).To(BeNil())
+		Expect(accepted).To(Equal(conn))
+
+		close(done)
+		_, err = listener.AcceptOrDone(done)
+		Expect(err).To(Equal(ErrAcceptDone))
+	})
+})
+
+var _ = Describe("Overflow policies", func() {
+	It("Should close the newest connection when dropping newest", func() {
+		listener := &Listener{OnFull: OverflowDropNewest}
+		channel := make(chan net.Conn, 1)
+
+		queued, _ := net.Pipe()
+		dropped, droppedPeer := net.Pipe()
+		listener.deliver("default", channel, queued, tls.ConnectionState{})
+		listener.deliver("default", channel, dropped, tls.ConnectionState{})
+
+		Expect(<-channel).To(Equal(queued))
+		_, err := droppedPeer.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+	})
+
+	It("Should close the oldest connection when dropping oldest", func() {
+		listener := &Listener{OnFull: OverflowDropOldest}
+		events := listener.Events()
+		channel := make(chan net.Conn, 1)
+
+		oldest, oldestPeer := net.Pipe()
+		newest, _ := net.Pipe()
+		listener.deliver("default", channel, oldest, tls.ConnectionState{})
+		listener.deliver("default", channel, newest, tls.ConnectionState{})
+
+		Expect(<-channel).To(Equal(newest))
+		_, err := oldestPeer.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+
+		Expect((<-events).Outcome).To(Equal(ConnRouted))
+		dropped := <-events
+		Expect(dropped.Listener).To(Equal("default"))
+		Expect(dropped.Outcome).To(Equal(ConnDropped))
+		Expect((<-events).Outcome).To(Equal(ConnRouted))
+		Expect(listener.Stats().ConnsDropped).To(Equal(uint64(1)))
+	})
+
+	It("Should report an error when rejecting", func() {
+		listener := &Listener{OnFull: OverflowReject, errors: make(chan error, 1)}
+		channel := make(chan net.Conn, 1)
+
+		queued, _ := net.Pipe()
+		rejected, _ := net.Pipe()
+		listener.deliver("default", channel, queued, tls.ConnectionState{})
+		listener.deliver("default", channel, rejected, tls.ConnectionState{})
+
+		Expect(<-channel).To(Equal(queued))
+		Expect((<-listener.errors).Error()).To(Equal("connection from pipe rejected: default listener queue is full"))
+	})
+})
+
+var _ = Describe("Raw listener", func() {
+	var rawListener net.Listener
+
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:    "127.0.0.1:6088",
+		PeekTimeout: 50 * time.Millisecond,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should deliver silent clients to the raw listener once the peek times out", func() {
+		var err error
+		rawListener, err = listener.RawListener()
+		Expect(err).To(BeNil())
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:6088")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		rawConn, err := rawListener.Accept()
+		Expect(err).To(BeNil())
+		defer rawConn.Close()
+
+		_, err = rawConn.Write([]byte("220 ready\r\n"))
+		Expect(err).To(BeNil())
+
+		buffer := make([]byte, 3)
+		_, err = io.ReadFull(conn, buffer)
+		Expect(err).To(BeNil())
+		Expect(string(buffer)).To(Equal("220"))
+	})
+})
+
+var _ = Describe("Middleware", func() {
+	It("Should pass connections through the chain in order", func() {
+		listener := &Listener{}
+		channel := make(chan net.Conn, 1)
+
+		var order []int
+		listener.Use(func(conn net.Conn) (net.Conn, error) {
+			order = append(order, 1)
+			return conn, nil
+		})
+		listener.Use(func(conn net.Conn) (net.Conn, error) {
+			order = append(order, 2)
+			return NewPrefixConn(conn, nil), nil
+		})
+
+		conn, _ := net.Pipe()
+		listener.deliver("default", channel, conn, tls.ConnectionState{})
+
+		Expect(order).To(Equal([]int{1, 2}))
+		Expect(<-channel).To(Equal(NewPrefixConn(conn, nil)))
+	})
+
+	It("Should close connections a middleware returns an error for", func() {
+		listener := &Listener{}
+		channel := make(chan net.Conn, 1)
+
+		listener.Use(func(conn net.Conn) (net.Conn, error) {
+			return nil, fmt.Errorf("dropped")
+		})
+
+		conn, peer := net.Pipe()
+		listener.deliver("default", channel, conn, tls.ConnectionState{})
+
+		Expect(len(channel)).To(Equal(0))
+		_, err := peer.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+	})
+})
+
+var _ = Describe("Ephemeral start", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6112",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should retry with a kernel assigned port when the port is in use", func() {
+		inUse, err := net.Listen("tcp", "127.0.0.1:6112")
+		Expect(err).To(BeNil())
+		defer inUse.Close()
+
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		addr, err := listener.StartEphemeral()
+		Expect(err).To(BeNil())
+		defer listener.Stop()
+
+		Expect(addr.(*net.TCPAddr).Port).ToNot(Equal(6112))
+		Expect(addr).To(Equal(listener.Addr()))
+
+		conn, err := tls.Dial("tcp", addr.String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := h2Listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+
+	It("Should bind the configured port again once it's free", func() {
+		Expect(listener.BindAddr).To(Equal("127.0.0.1:6112"))
+
+		addr, err := listener.StartEphemeral()
+		Expect(err).To(BeNil())
+		defer listener.Stop()
+
+		Expect(addr.(*net.TCPAddr).Port).To(Equal(6112))
+	})
+})
+
+var _ = Describe("Socket families", func() {
+	It("Should bind IPv4 addresses with an IPv4 socket", func() {
+		listener := &Listener{BindAddr: "127.0.0.1:0"}
+
+		sockAddr, err := listener.getSocketAddress()
+		Expect(err).To(BeNil())
+		Expect(sockAddr).To(Equal(&syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	})
+
+	It("Should bind IPv6 addresses with an IPv6 socket", func() {
+		listener := &Listener{BindAddr: "[::1]:0"}
+
+		sockAddr, err := listener.getSocketAddress()
+		Expect(err).To(BeNil())
+		Expect(sockAddr).To(Equal(&syscall.SockaddrInet6{Addr: [16]byte{15: 1}}))
+	})
+
+	It("Should resolve the host with the listener's resolver", func() {
+		var dialed atomic.Bool
+		listener := &Listener{
+			BindAddr: "tlsprotocol.invalid:0",
+			Resolver: &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					dialed.Store(true)
+					return nil, errors.New("no name servers")
+				},
+			},
+		}
+
+		_, err := listener.getSocketAddress()
+		Expect(err).ToNot(BeNil())
+		Expect(dialed.Load()).To(BeTrue())
+
+		listener.BindAddr = "127.0.0.1:0"
+		sockAddr, err := listener.getSocketAddress()
+		Expect(err).To(BeNil())
+		Expect(sockAddr).To(Equal(&syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	})
+
+	It("Should parse ports from the whole port range", func() {
+		listener := &Listener{BindAddr: "127.0.0.1:65535"}
+
+		sockAddr, err := listener.getSocketAddress()
+		Expect(err).To(BeNil())
+		Expect(sockAddr).To(Equal(&syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 65535}))
+
+		listener = &Listener{BindAddr: "127.0.0.1:65536"}
+		_, err = listener.getSocketAddress()
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Interrupted syscalls", func() {
+	It("Should retry syscalls interrupted by a signal", func() {
+		calls := 0
+		err := ignoringEINTR(func() error {
+			if calls++; calls < 3 {
+				return syscall.EINTR
+			}
+
+			return nil
+		})
+
+		Expect(err).To(BeNil())
+		Expect(calls).To(Equal(3))
+	})
+
+	It("Should return other errors without retrying", func() {
+		calls := 0
+		err := ignoringEINTR(func() error {
+			calls++
+			return syscall.EADDRINUSE
+		})
+
+		Expect(err).To(Equal(syscall.EADDRINUSE))
+		Expect(calls).To(Equal(1))
+	})
+})
+
+// staticResolver returns a resolver that answers every
+// A and AAAA query with the addresses of that family
+func staticResolver(ips ...net.IP) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, peer := net.Pipe()
+			go func() {
+				defer peer.Close()
+
+				length := make([]byte, 2)
+				if _, err := io.ReadFull(peer, length); err != nil {
+					return
+				}
+
+				query := make([]byte, binary.BigEndian.Uint16(length))
+				if _, err := io.ReadFull(peer, query); err != nil {
+					return
+				}
+
+				// the question follows the 12 byte header,
+				// the name ends at a zero length label
+				end := 12
+				for query[end] != 0 {
+					end += int(query[end]) + 1
+				}
+				qtype := binary.BigEndian.Uint16(query[end+1:])
+
+				var answers []byte
+				count := byte(0)
+				for _, ip := range ips {
+					rdata := ip.To4()
+					if qtype == 28 && rdata == nil {
+						rdata = ip.To16()
+					} else if qtype != 1 || rdata == nil {
+						continue
+					}
+
+					answers = append(answers, 0xc0, 12, 0, byte(qtype), 0, 1, 0, 0, 0, 60, 0, byte(len(rdata)))
+					answers = append(answers, rdata...)
+					count++
+				}
+
+				response := []byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, count, 0, 0, 0, 0}
+				response = append(response, query[12:end+5]...)
+				response = append(response, answers...)
+
+				peer.Write(binary.BigEndian.AppendUint16(nil, uint16(len(response))))
+				peer.Write(response)
+			}()
+
+			return conn, nil
+		},
+	}
+}
+
+var _ = Describe("Dual stack", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+
+	It("Should bind both families of a hostname", func() {
+		listener := &Listener{
+			BindAddr:  "dualstack.test:0",
+			Resolver:  staticResolver(net.ParseIP("::1"), net.ParseIP("127.0.0.1")),
+			DualStack: true,
+			Listeners: 2,
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		Expect(listener.workers).To(HaveLen(4))
+
+		addrs := listener.Addrs()
+		Expect(addrs).To(HaveLen(2))
+		Expect(addrs[0]).To(Equal(listener.Addr()))
+		Expect(addrs[0].(*net.TCPAddr).IP.To4()).ToNot(BeNil())
+		Expect(addrs[1].(*net.TCPAddr).IP.Equal(net.IPv6loopback)).To(BeTrue())
+		Expect(addrs[1].(*net.TCPAddr).Port).To(Equal(addrs[0].(*net.TCPAddr).Port))
+
+		for i := range addrs {
+			conn, err := tls.Dial("tcp", addrs[i].String(), &tls.Config{InsecureSkipVerify: true})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+
+			serverConn, worker, err := listener.AcceptFrom()
+			Expect(err).To(BeNil())
+			Expect(worker / 2).To(Equal(i))
+			serverConn.Close()
+		}
+	})
+
+	It("Should bind a single family without DualStack", func() {
+		listener := &Listener{
+			BindAddr: "dualstack.test:0",
+			Resolver: staticResolver(net.ParseIP("::1"), net.ParseIP("127.0.0.1")),
+		}
+
+		_, err := listener.getSocketAddress()
+		Expect(err).To(BeNil())
+		Expect(listener.Addrs()).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Ephemeral ports", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:  "127.0.0.1:0",
+		Listeners: 2,
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should report the kernel assigned port and bind every worker to it", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		port := listener.Addr().(*net.TCPAddr).Port
+		Expect(port).ToNot(Equal(0))
+
+		for _, worker := range listener.workers {
+			Expect(worker.socket.Addr().(*net.TCPAddr).Port).To(Equal(port))
+		}
+
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+
+	It("Should report the kernel assigned port before the workers are started", func() {
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		Expect(listener.StartPaused()).To(BeNil())
+		defer listener.Stop()
+
+		port := listener.Addr().(*net.TCPAddr).Port
+		Expect(port).ToNot(Equal(0))
+		Expect(h2Listener.Addr().(*ProtocolAddr).Addr).To(Equal(listener.Addr()))
+
+		Expect(listener.Resume()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Connection IDs", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6091",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should assign each delivered connection an increasing ID", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		for id := uint64(1); id <= 2; id++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6091", &tls.Config{InsecureSkipVerify: true})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+
+			serverConn, err := listener.Accept()
+			Expect(err).To(BeNil())
+			defer serverConn.Close()
+
+			tracked, ok := ConnFrom(serverConn)
+			Expect(ok).To(BeTrue())
+			Expect(tracked.ID()).To(Equal(id))
+		}
+	})
+
+	It("Should report the worker that accepted the connection", func() {
+		listener.Listeners = 2
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6091", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, worker, err := listener.AcceptFrom()
+		Expect(err).To(BeNil())
+		defer serverConn.Close()
+
+		Expect(worker).To(BeElementOf(0, 1))
+	})
+
+	It("Should record when the connection was accepted and handshaked", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		before := time.Now()
+		conn, err := tls.Dial("tcp", "127.0.0.1:6091", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		defer serverConn.Close()
+
+		tracked, _ := ConnFrom(serverConn)
+		Expect(tracked.AcceptedAt()).To(BeTemporally(">=", before))
+		Expect(tracked.HandshakeCompletedAt()).To(BeTemporally(">=", tracked.AcceptedAt()))
+		Expect(tracked.HandshakeCompletedAt()).To(BeTemporally("<=", time.Now()))
+	})
+})
+
+var _ = Describe("Graceful stop", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	newListener := func() *Listener {
+		return &Listener{
+			BindAddr: "127.0.0.1:6092",
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+	}
+
+	It("Should wait for queued connections to be accepted", func() {
+		listener := newListener()
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6092", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			serverConn, _ := listener.Accept()
+			serverConn.Close()
+		}()
+
+		Expect(listener.GracefulStop(2 * time.Second)).To(Equal(0))
+		Expect(listener.Done()).To(BeClosed())
+	})
+
+	It("Should force close connections that remain after the timeout", func() {
+		listener := newListener()
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6092", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		idleConn, err := net.Dial("tcp", "127.0.0.1:6092")
+		Expect(err).To(BeNil())
+		defer idleConn.Close()
+
+		Eventually(listener.inFlight.Load).Should(Equal(int64(1)))
+		Expect(listener.GracefulStop(50 * time.Millisecond)).To(Equal(2))
+
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Closing connections", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6094",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should close the delivered connections that match the filter", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		h2Conn, err := tls.Dial("tcp", "127.0.0.1:6094", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer h2Conn.Close()
+
+		h2ServerConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		defer h2ServerConn.Close()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6094", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+
+		Expect(listener.CloseConns(func(conn *Conn) bool { return conn.Proto() == "h2" })).To(Equal(1))
+
+		_, err = h2Conn.Read(make([]byte, 1))
+		Expect(err).ToNot(BeNil())
+
+		serverConn.Close()
+		Expect(listener.CloseConns(nil)).To(Equal(0))
+	})
+
+	It("Should close a single delivered connection", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6094", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+
+		Expect(listener.CloseConn(serverConn)).To(Succeed())
+
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+
+		Expect(listener.CloseConn(serverConn)).ToNot(Succeed())
+
+		pipe, _ := net.Pipe()
+		Expect(listener.CloseConn(pipe)).ToNot(Succeed())
+	})
+
+	It("Should write a goodbye before closing a single delivered connection", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6094", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+
+		Expect(listener.CloseConnWith(serverConn, []byte("goodbye"), 0)).ToNot(Succeed())
+
+		closed := make(chan error, 1)
+		go func() { closed <- listener.CloseConnWith(serverConn, []byte("goodbye"), time.Second) }()
+
+		_, err = conn.Write([]byte("unread"))
+		Expect(err).To(BeNil())
+
+		message, err := io.ReadAll(conn)
+		Expect(err).To(BeNil())
+		Expect(string(message)).To(Equal("goodbye"))
+
+		Expect(conn.Close()).To(Succeed())
+		Eventually(closed).Should(Receive(BeNil()))
+
+		Expect(listener.CloseConn(serverConn)).ToNot(Succeed())
+	})
+})
+
+var _ = Describe("Socket buffers", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+
+	It("Shouldn't start with a negative buffer size", func() {
+		listener := &Listener{BindAddr: "127.0.0.1:6095", SendBuffer: -1, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+		Expect(listener.Start()).To(MatchError("send buffer size can't be negative: -1"))
+	})
+
+	It("Should apply the buffer sizes to the sockets", func() {
+		listener := &Listener{
+			BindAddr:   "127.0.0.1:6095",
+			SendBuffer: 64 * 1024,
+			RecvBuffer: 64 * 1024,
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		send, recv := listener.SocketBuffers()
+		Expect(send).To(BeNumerically(">=", 64*1024))
+		Expect(recv).To(BeNumerically(">=", 64*1024))
+	})
+
+	It("Should set SO_REUSEADDR unless it is disabled", func() {
+		reuseAddr := func(listener *Listener) int {
+			rawConn, err := listener.workers[0].socket.(*net.TCPListener).SyscallConn()
+			Expect(err).To(BeNil())
+
+			var value int
+			Expect(rawConn.Control(func(fd uintptr) {
+				value, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR)
+			})).To(Succeed())
+			Expect(err).To(BeNil())
+
+			return value
+		}
+
+		disabled := false
+		for _, setting := range []*bool{nil, &disabled} {
+			listener := &Listener{
+				BindAddr:  "127.0.0.1:6095",
+				ReuseAddr: setting,
+				TLSConfig: &tls.Config{
+					Certificates: []tls.Certificate{cert},
+				},
+			}
+
+			Expect(listener.Start()).To(BeNil())
+			if setting == nil {
+				Expect(reuseAddr(listener)).ToNot(BeZero())
+			} else {
+				Expect(reuseAddr(listener)).To(BeZero())
+			}
+			listener.Stop()
+		}
+	})
+})
+
+var _ = Describe("Synchronous handshakes", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:      "127.0.0.1:6097",
+		SyncHandshake: true,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should deliver connections in the order they were accepted", func() {
+		Expect(listener.Start()).To(BeNil())
+
+		for i := 0; i < 2; i++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6097", &tls.Config{InsecureSkipVerify: true})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+		}
+
+		for id := uint64(1); id <= 2; id++ {
+			serverConn, err := listener.Accept()
+			Expect(err).To(BeNil())
+			defer serverConn.Close()
+
+			tracked, _ := ConnFrom(serverConn)
+			Expect(tracked.ID()).To(Equal(id))
+		}
+	})
+
+	It("Should stop while a worker is blocked delivering a connection", func() {
+		for i := 0; i < 2; i++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6097", &tls.Config{InsecureSkipVerify: true})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+		}
+
+		Eventually(func() int { return len(listener.defaultChannel) }).Should(Equal(1))
+
+		stopped := make(chan struct{})
+		go func() {
+			listener.Stop()
+			close(stopped)
+		}()
+
+		Eventually(stopped).Should(BeClosed())
+	})
+})
+
+var _ = Describe("Per worker control", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+
+	It("Should name each worker socket after the listener", func() {
+		listener := &Listener{BindAddr: "127.0.0.1:6098"}
+		Expect(listener.socketFileName(1)).To(Equal("tls-Protocol-listener[127.0.0.1:6098#1]"))
+
+		listener.SocketName = "api"
+		Expect(listener.socketFileName(0)).To(Equal("api[127.0.0.1:6098#0]"))
+	})
+
+	It("Should call the control function for each worker socket", func() {
+		var indexes []int
+		listener := &Listener{
+			BindAddr:  "127.0.0.1:6098",
+			Listeners: 2,
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+			PerWorkerControl: func(index int, c syscall.RawConn) error {
+				indexes = append(indexes, index)
+				return c.Control(func(fd uintptr) {})
+			},
+		}
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		Expect(indexes).To(Equal([]int{0, 1}))
+	})
+
+	It("Should fail to start if the control function fails", func() {
+		listener := &Listener{
+			BindAddr: "127.0.0.1:6098",
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+			PerWorkerControl: func(index int, c syscall.RawConn) error {
+				return fmt.Errorf("unsupported")
+			},
+		}
+
+		err := listener.Start()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("worker 0 control: unsupported"))
+	})
+})
+
+var _ = Describe("Socket errors", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+
+	It("Should identify the failing system call", func() {
+		listener := &Listener{
+			BindAddr: "192.0.2.1:6101",
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+
+		err := listener.Start()
+		Expect(err).ToNot(BeNil())
+
+		var socketErr *SocketError
+		Expect(errors.As(err, &socketErr)).To(BeTrue())
+		Expect(socketErr.Op).To(Equal("bind"))
+		Expect(errors.Is(err, syscall.EADDRNOTAVAIL)).To(BeTrue())
+	})
+})
+
+var _ = Describe("Paused start", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6102",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Shouldn't resume a listener that hasn't started", func() {
+		Expect(listener.Resume()).To(MatchError("listener must be started before resuming"))
+	})
+
+	It("Should only accept connections once resumed", func() {
+		Expect(listener.StartPaused()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:6102")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		client := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		handshake := make(chan error, 1)
+		go func() { handshake <- client.Handshake() }()
+
+		Consistently(handshake, 200*time.Millisecond).ShouldNot(Receive())
+
+		Expect(listener.Resume()).To(BeNil())
+		Eventually(handshake).Should(Receive(BeNil()))
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+
+	It("Should stop accepting connections while paused", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		Expect(listener.Pause()).To(BeNil())
+
+		conn, err := net.Dial("tcp", "127.0.0.1:6102")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		client := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		handshake := make(chan error, 1)
+		go func() { handshake <- client.Handshake() }()
+
+		Consistently(handshake, 200*time.Millisecond).ShouldNot(Receive())
+
+		Expect(listener.Resume()).To(BeNil())
+		Eventually(handshake).Should(Receive(BeNil()))
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Worker scaling", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:   "127.0.0.1:6149",
+		BufferSize: 8,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Shouldn't set the listeners before starting", func() {
+		Expect(listener.SetListeners(2)).ToNot(BeNil())
+	})
+
+	It("Should add and remove sockets while accepting", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		Expect(listener.SetListeners(3)).To(BeNil())
+		Expect(listener.workers).To(HaveLen(3))
+		Expect(listener.workers[2].index).To(Equal(2))
+		Expect(listener.workers[2].isRunning()).To(BeTrue())
+
+		Expect(listener.SetListeners(1)).To(BeNil())
+		Expect(listener.workers).To(HaveLen(1))
+		Expect(listener.Listeners).To(Equal(1))
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6149", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+
+	It("Should hand the connections queued on removed sockets to the listener", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		Expect(listener.SetListeners(4)).To(BeNil())
+		Expect(listener.Pause()).To(BeNil())
+
+		var conns []net.Conn
+		for i := 0; i < 8; i++ {
+			conn, err := net.Dial("tcp", "127.0.0.1:6149")
+			Expect(err).To(BeNil())
+			defer conn.Close()
+			conns = append(conns, conn)
+		}
+
+		Expect(listener.SetListeners(1)).To(BeNil())
+		Expect(listener.Resume()).To(BeNil())
+
+		for _, conn := range conns {
+			conn.SetDeadline(time.Now().Add(time.Second))
+			Expect(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()).To(BeNil())
+
+			serverConn, err := listener.Accept()
+			Expect(err).To(BeNil())
+			serverConn.Close()
+		}
+	})
+})
+
+var _ = Describe("ClientHello size limit", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:           "127.0.0.1:6105",
+		MaxClientHelloSize: 64,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should reject connections with a ClientHello over the limit", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6105", &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+		}
+		Expect(err).ToNot(BeNil())
+
+		Eventually(listener.Errors()).Should(Receive(MatchError(ContainSubstring("rejected: ClientHello exceeds 64 bytes"))))
+	})
+
+	It("Should deliver connections with a ClientHello under the limit", func() {
+		listener.MaxClientHelloSize = 4096
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6105", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		defer serverConn.Close()
+
+		_, ok := ConnFrom(serverConn)
+		Expect(ok).To(BeTrue())
+	})
+})
+
+var _ = Describe("Protocol backlogs", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6106",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Shouldn't allow an empty backlog", func() {
+		_, err := listener.ProtocolWithBacklog("h2", 0, OverflowReject)
+		Expect(err).To(MatchError("protocol backlog size must be at least 1: 0"))
+	})
+
+	It("Should follow the protocol's overflow policy when its backlog is full", func() {
+		h2Listener, err := listener.ProtocolWithBacklog("h2", 2, OverflowReject)
+		Expect(err).To(BeNil())
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		for i := 0; i < 3; i++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6106", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+		}
+
+		Eventually(listener.Errors()).Should(Receive(MatchError(ContainSubstring("h2 listener queue is full"))))
+
+		for i := 0; i < 2; i++ {
+			serverConn, err := h2Listener.Accept()
+			Expect(err).To(BeNil())
+			serverConn.Close()
+		}
+	})
+})
+
+var _ = Describe("Handshake rate limit", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	clock := &fakeClock{now: time.Now()}
+	listener := &Listener{
+		BindAddr:               "127.0.0.1:6142",
+		MaxHandshakesPerSecond: 1,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		clock: clock,
+	}
+
+	It("Should shed connections over the handshake rate", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6142", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		_, err = tls.Dial("tcp", "127.0.0.1:6142", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).ToNot(BeNil())
+		Eventually(func() uint64 { return listener.Stats().HandshakesShed }).Should(Equal(uint64(1)))
+
+		clock.After(time.Second)
+		Expect(listener.Stats().HandshakeRate).To(Equal(float64(1)))
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:6142", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err = listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Connection sampling", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	sink := &bytes.Buffer{}
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6141",
+		SampleConn: func(conn net.Conn) bool {
+			tracked, _ := ConnFrom(conn)
+			return tracked.ID() == 1
+		},
+		SampleWriter: sink,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should record what sampled connections read and write", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6141", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		Expect(serverConn).To(BeAssignableToTypeOf(&SampledConn{}))
+
+		_, err = conn.Write([]byte("ping"))
+		Expect(err).To(BeNil())
+		_, err = io.ReadFull(serverConn, make([]byte, 4))
+		Expect(err).To(BeNil())
+		_, err = serverConn.Write([]byte("pong"))
+		Expect(err).To(BeNil())
+
+		Expect(sink.Len()).To(Equal(0))
+		serverConn.Close()
+		Expect(sink.String()).To(Equal("1 read 4\nping1 write 4\npong"))
+
+		unsampled, err := tls.Dial("tcp", "127.0.0.1:6141", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer unsampled.Close()
+
+		serverConn, err = listener.Accept()
+		Expect(err).To(BeNil())
+		Expect(serverConn).To(BeAssignableToTypeOf(&tls.Conn{}))
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Buffered writes", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:       "127.0.0.1:6113",
+		BufferedWrites: 4096,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should coalesce writes and flush them", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6113", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		Expect(serverConn).To(BeAssignableToTypeOf(&BufferedConn{}))
+
+		_, ok := ConnFrom(serverConn)
+		Expect(ok).To(BeTrue())
+
+		for _, frame := range []string{"a", "b", "c"} {
+			_, err = serverConn.Write([]byte(frame))
+			Expect(err).To(BeNil())
+		}
+
+		buffer := make([]byte, 3)
+		_, err = io.ReadFull(conn, buffer)
+		Expect(err).To(BeNil())
+		Expect(string(buffer)).To(Equal("abc"))
+
+		_, err = serverConn.Write([]byte("closing"))
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		rest, err := io.ReadAll(conn)
+		Expect(err).To(BeNil())
+		Expect(string(rest)).To(Equal("closing"))
+	})
+})
+
+var _ = Describe("Drain hook", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	newListener := func(hook func(conn net.Conn)) *Listener {
+		return &Listener{
+			BindAddr:         "127.0.0.1:6114",
+			DrainHook:        hook,
+			DrainHookTimeout: 100 * time.Millisecond,
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+	}
+
+	It("Should call the hook before closing queued connections", func() {
+		listener := newListener(func(conn net.Conn) {
+			conn.Write([]byte("goodbye"))
+		})
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6114", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		Eventually(func() int { return len(listener.defaultChannel) }).Should(Equal(1))
+		listener.Stop()
+
+		message, err := io.ReadAll(conn)
+		Expect(err).To(BeNil())
+		Expect(string(message)).To(Equal("goodbye"))
+	})
+
+	It("Should not wait for a hook past the timeout", func() {
+		release := make(chan struct{})
+		defer close(release)
+
+		listener := newListener(func(conn net.Conn) {
+			<-release
+		})
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6114", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		Eventually(func() int { return len(listener.defaultChannel) }).Should(Equal(1))
+		go listener.Stop()
+
+		Eventually(listener.Done(), time.Second).Should(BeClosed())
+
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("Should set the deadlines of queued connections from the wall clock", func() {
+		written := make(chan error, 1)
+		listener := newListener(func(conn net.Conn) {
+			_, err := conn.Write([]byte("goodbye"))
+			written <- err
+		})
+		listener.clock = skewedClock{offset: -time.Hour}
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6114", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		Eventually(func() int { return len(listener.defaultChannel) }).Should(Equal(1))
+		listener.Stop()
+
+		Expect(errors.Is(<-written, os.ErrDeadlineExceeded)).To(BeFalse())
+	})
+})
+
+var _ = Describe("Accept go routines", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:         "127.0.0.1:6115",
+		AcceptGoroutines: 4,
+		BufferSize:       8,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should accept connections from every go routine and stop them", func() {
+		Expect(listener.Start()).To(BeNil())
+
+		for i := 0; i < 8; i++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6115", &tls.Config{InsecureSkipVerify: true})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+
+			serverConn, err := listener.Accept()
+			Expect(err).To(BeNil())
+			serverConn.Close()
+		}
+
+		Expect(listener.Pause()).To(BeNil())
+		Expect(listener.Resume()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6115", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		listener.Stop()
+		Expect(listener.Done()).To(BeClosed())
+	})
+
+	It("Should refuse a negative number of go routines", func() {
+		listener := &Listener{
+			BindAddr:         "127.0.0.1:6115",
+			AcceptGoroutines: -1,
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+
+		Expect(listener.Start()).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Queue depths", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:   "127.0.0.1:6117",
+		BufferSize: 4,
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should report the depth and high-water mark of each channel", func() {
+		_, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		for i := 0; i < 2; i++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6117", &tls.Config{InsecureSkipVerify: true})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+		}
+
+		Eventually(func() QueueStats { return listener.Stats().Queues["default"] }).Should(Equal(QueueStats{Depth: 2, HighWater: 2}))
+		Expect(listener.Stats().Queues["h2"]).To(Equal(QueueStats{}))
+
+		for i := 0; i < 2; i++ {
+			serverConn, err := listener.Accept()
+			Expect(err).To(BeNil())
+			serverConn.Close()
+		}
+
+		Expect(listener.Stats().Queues["default"]).To(Equal(QueueStats{HighWater: 2}))
+		Expect(listener.ResetStats().Queues["default"]).To(Equal(QueueStats{HighWater: 2}))
+		Expect(listener.Stats().Queues["default"]).To(Equal(QueueStats{}))
+	})
+})
+
+var _ = Describe("Partial binds", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	newListener := func(partial bool, failing ...int) *Listener {
+		return &Listener{
+			BindAddr:    "127.0.0.1:6121",
+			Listeners:   3,
+			PartialBind: partial,
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+			PerWorkerControl: func(index int, c syscall.RawConn) error {
+				for _, failed := range failing {
+					if index == failed {
+						return fmt.Errorf("unsupported")
+					}
+				}
+
+				return nil
+			},
+		}
+	}
+
+	It("Should roll back every socket by default", func() {
+		listener := newListener(false, 1)
+		Expect(listener.Start()).ToNot(BeNil())
+		Expect(listener.workers).To(BeEmpty())
+
+		socket, err := net.Listen("tcp", "127.0.0.1:6121")
+		Expect(err).To(BeNil())
+		socket.Close()
+	})
+
+	It("Should start with the sockets that bound and report the others", func() {
+		listener := newListener(true, 1)
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		Expect(listener.workers).To(HaveLen(2))
+		Expect(listener.workers[1].index).To(Equal(2))
+
+		_, err := listener.Accept()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("worker 1 control: unsupported"))
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6121", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+
+	It("Should fail with every error if no socket binds", func() {
+		listener := newListener(true, 0, 1, 2)
+
+		err := listener.Start()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("worker 0 control: unsupported"))
+		Expect(err.Error()).To(ContainSubstring("worker 2 control: unsupported"))
+	})
+})
+
+var _ = Describe("Connection contexts", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6124",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should cancel the context once the connection is closed", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6124", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+
+		tracked, ok := ConnFrom(serverConn)
+		Expect(ok).To(BeTrue())
+
+		ctx := tracked.Context()
+		Expect(ctx.Err()).To(BeNil())
+
+		serverConn.Close()
+		Eventually(ctx.Done()).Should(BeClosed())
+		Expect(ctx.Err()).To(Equal(context.Canceled))
+	})
+})
+
+var _ = Describe("Waiting for connections", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6127",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should return the first connection delivered to any listener", func() {
+		_, _, err := listener.WaitForConnection(context.Background())
+		Expect(err).ToNot(BeNil())
+
+		_, err = listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6127", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, name, err := listener.WaitForConnection(context.Background())
+		Expect(err).To(BeNil())
+		Expect(name).To(Equal("h2"))
+		serverConn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, _, err = listener.WaitForConnection(ctx)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+})
+
+var _ = Describe("Connection lifetimes", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	clock := &fakeClock{now: time.Now()}
+	listener := &Listener{
+		BindAddr:        "127.0.0.1:6129",
+		MaxConnLifetime: 100 * time.Millisecond,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		clock: clock,
+	}
+
+	It("Should close connections once their lifetime elapses", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6129", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		defer serverConn.Close()
+
+		tracked, _ := ConnFrom(serverConn)
+		clock.Advance(99 * time.Millisecond)
+		Expect(tracked.Context().Done()).ToNot(BeClosed())
+
+		clock.Advance(time.Millisecond)
+		Expect(tracked.Context().Done()).To(BeClosed())
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+	})
+})
+
+var _ = Describe("Debug snapshot", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:   "127.0.0.1:6130",
+		Listeners:  2,
+		BufferSize: 4,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2"},
+		},
+	}
+
+	It("Should describe the workers and channels", func() {
+		_, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		Expect(listener.StartPaused()).To(BeNil())
+		defer listener.Stop()
+
+		debug := listener.Debug()
+		Expect(debug).To(ContainSubstring("listener 127.0.0.1:6130"))
+		Expect(debug).To(ContainSubstring("workers: 2\n"))
+		Expect(debug).To(ContainSubstring("worker 1: stopped"))
+		Expect(debug).To(ContainSubstring("  default: 0/4\n"))
+		Expect(debug).To(ContainSubstring("  h2: 0/4\n"))
+		Expect(debug).To(ContainSubstring("errors: 0/64\n"))
+
+		Expect(listener.Resume()).To(BeNil())
+		Expect(listener.Debug()).To(ContainSubstring("worker 0: running"))
+
+		Expect(listener.Pause()).To(BeNil())
+		Expect(listener.Debug()).To(ContainSubstring("worker 0: paused"))
+	})
+})
+
+var _ = Describe("Worker exits", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	exits := make(chan int, 2)
+	listener := &Listener{
+		BindAddr:         "127.0.0.1:6132",
+		Listeners:        2,
+		AcceptGoroutines: 2,
+		OnWorkerExit: func(index int, err error) {
+			exits <- index
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should report a worker whose socket fails", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		listener.workers[1].socket.Close()
+		Eventually(exits).Should(Receive(Equal(1)))
+		Consistently(exits, 100*time.Millisecond).ShouldNot(Receive())
+
+		_, err := listener.Accept()
+		Expect(errors.Is(err, net.ErrClosed)).To(BeTrue())
+
+		Expect(listener.Resume()).To(BeNil())
+		Expect(listener.Debug()).To(ContainSubstring("worker 1: exited"))
+	})
+
+	It("Shouldn't report workers stopped with the listener", func() {
+		Expect(listener.Start()).To(BeNil())
+		listener.Stop()
+
+		Consistently(exits, 100*time.Millisecond).ShouldNot(Receive())
+	})
+})
+
+var _ = Describe("Respawning workers", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	exits := make(chan int, 1)
+	listener := &Listener{
+		BindAddr:       "127.0.0.1:6133",
+		Listeners:      2,
+		RespawnWorkers: true,
+		OnWorkerExit: func(index int, err error) {
+			exits <- index
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should rebuild the socket of a worker that exits", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		listener.workers[1].socket.Close()
+		Eventually(exits).Should(Receive(Equal(1)))
+		Eventually(listener.Debug).Should(ContainSubstring("worker 1: running"))
+
+		_, err := listener.Accept()
+		Expect(errors.Is(err, net.ErrClosed)).To(BeTrue())
+
+		accepted := map[int]bool{}
+		for i := 0; i < 20; i++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6133", &tls.Config{InsecureSkipVerify: true})
+			Expect(err).To(BeNil())
+
+			serverConn, worker, err := listener.AcceptFrom()
+			Expect(err).To(BeNil())
+			accepted[worker] = true
+
+			serverConn.Close()
+			conn.Close()
+		}
+
+		Expect(accepted).To(HaveKey(1))
+	})
+})
+
+var _ = Describe("Idle timeouts", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	clock := &fakeClock{now: time.Now()}
+	listener := &Listener{
+		BindAddr:    "127.0.0.1:6134",
+		IdleTimeout: 100 * time.Millisecond,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		clock: clock,
+	}
+
+	It("Should only close connections once they go idle", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6134", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		defer serverConn.Close()
+
+		buf := make([]byte, 1)
+		for i := 0; i < 6; i++ {
+			clock.Advance(50 * time.Millisecond)
+
+			_, err = conn.Write([]byte("x"))
+			Expect(err).To(BeNil())
+			_, err = serverConn.Read(buf)
+			Expect(err).To(BeNil())
+		}
+
+		clock.Advance(100 * time.Millisecond)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(buf)
+		Expect(err).To(Equal(io.EOF))
+	})
+})
+
+var _ = Describe("Pending handshakes", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:             "127.0.0.1:6135",
+		MaxPendingHandshakes: 1,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should close connections over the limit without a handshake", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		first, err := net.Dial("tcp", "127.0.0.1:6135")
+		Expect(err).To(BeNil())
+		defer first.Close()
+
+		Eventually(func() int64 { return listener.Stats().PendingHandshakes }).Should(Equal(int64(1)))
+
+		second, err := net.Dial("tcp", "127.0.0.1:6135")
+		Expect(err).To(BeNil())
+		defer second.Close()
+
+		second.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = second.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+
+		client := tls.Client(first, &tls.Config{InsecureSkipVerify: true})
+		Expect(client.Handshake()).To(BeNil())
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		Expect(listener.Stats().PendingHandshakes).To(Equal(int64(0)))
+	})
+})
+
+var _ = Describe("Renegotiation attempts", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	attempts := make(chan uint64, 1)
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6137",
+		OnRenegotiation: func(conn *Conn) {
+			attempts <- conn.ID()
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should report handshake records sent after the handshake", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		rawConn, err := net.Dial("tcp", "127.0.0.1:6137")
+		Expect(err).To(BeNil())
+		defer rawConn.Close()
+
+		conn := tls.Client(rawConn, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+		Expect(conn.Handshake()).To(BeNil())
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		defer serverConn.Close()
+
+		_, err = conn.Write([]byte("ping"))
+		Expect(err).To(BeNil())
+		_, err = serverConn.Read(make([]byte, 4))
+		Expect(err).To(BeNil())
+		Expect(attempts).ToNot(Receive())
+
+		_, err = rawConn.Write([]byte{22, 3, 3, 0, 4, 1, 0, 0, 0})
+		Expect(err).To(BeNil())
+		_, err = serverConn.Read(make([]byte, 4))
+		Expect(err).ToNot(BeNil())
+
+		tracked, _ := ConnFrom(serverConn)
+		Expect(attempts).To(Receive(Equal(tracked.ID())))
+		Expect(listener.Stats().Renegotiations).To(Equal(uint64(1)))
+	})
+})
+
+// serverNameDispatcher routes connections
+// by their SNI server name
+type serverNameDispatcher map[string]string
+
+func (dispatcher serverNameDispatcher) Dispatch(conn *tls.Conn, state tls.ConnectionState) (string, bool) {
+	target, ok := dispatcher[state.ServerName]
+	return target, ok
+}
+
+var _ = Describe("Custom dispatchers", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:   "127.0.0.1:6139",
+		Dispatcher: serverNameDispatcher{"grpc.example.com": "grpc"},
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2", "grpc"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should route connections where the dispatcher decides", func() {
+		grpcListener, err := listener.Protocol("grpc")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6139", &tls.Config{InsecureSkipVerify: true, ServerName: "grpc.example.com", NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := grpcListener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:6139", &tls.Config{InsecureSkipVerify: true, ServerName: "other.example.com", NextProtos: []string{"grpc"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err = listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
+
+var _ = Describe("Rejected connections", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:       "127.0.0.1:6140",
+		RejectedBuffer: 1,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should hand failed handshakes to the consumer", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:6140")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		Expect(err).To(BeNil())
+
+		var rejected RejectedConn
+		Eventually(listener.Rejected()).Should(Receive(&rejected))
+		Expect(rejected.Outcome).To(Equal(ConnHandshakeFailed))
+		Expect(rejected.Err).ToNot(BeNil())
+
+		_, err = rejected.Conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		Expect(err).To(BeNil())
+		rejected.Conn.Close()
+
+		response, err := io.ReadAll(conn)
+		Expect(err).To(BeNil())
+		Expect(string(response)).To(Equal("HTTP/1.1 400 Bad Request\r\n\r\n"))
+	})
+
+	It("Should close the rejected connections left when stopping", func() {
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := net.Dial("tcp", "127.0.0.1:6140")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		Expect(err).To(BeNil())
+		Eventually(func() int { return len(listener.Rejected()) }).Should(Equal(1))
+
+		rejected := listener.Rejected()
+		listener.Stop()
+		Eventually(rejected).Should(BeClosed())
+
+		_, err = io.ReadAll(conn)
+		Expect(err).To(BeNil())
+	})
+})
+
+var _ = Describe("Wrapped listeners", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	config := &tls.Config{
+		NextProtos:   []string{"h2"},
+		Certificates: []tls.Certificate{cert},
+	}
+
+	It("Should route the connections of a raw listener", func() {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+
+		listener := Wrap(inner, config)
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+		Expect(listener.Addr()).To(Equal(inner.Addr()))
+
+		conn, err := tls.Dial("tcp", inner.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := h2Listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+
+	It("Should handshake the connections of a TLS listener itself", func() {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+
+		listener := Wrap(tls.NewListener(inner, &tls.Config{}), config)
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+
+		conn, err := tls.Dial("tcp", inner.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := h2Listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		listener.Stop()
+		_, err = inner.Accept()
+		Expect(errors.Is(err, net.ErrClosed)).To(BeTrue())
+	})
+})
+
+var _ = Describe("Serving the default listener", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6144",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "default")
+	})
+
+	It("Should serve HTTP on the default listener until the server is closed", func() {
+		Expect(listener.ServeDefault(&http.Server{})).ToNot(Succeed())
+
+		Expect(listener.Start()).To(BeNil())
+
+		server := &http.Server{Handler: handler}
+		served := make(chan error, 1)
+		go func() { served <- listener.ServeDefault(server) }()
+
+		resp, err := client.Get("https://127.0.0.1:6144")
+		Expect(err).To(BeNil())
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(string(body)).To(Equal("default"))
+
+		Expect(server.Close()).To(Succeed())
+		Eventually(served).Should(Receive(Equal(http.ErrServerClosed)))
+
+		select {
+		case <-listener.Done():
+			Fail("listener was stopped with the server")
+		default:
+		}
+	})
+
+	It("Should stop serving once the listener is stopped", func() {
+		served := make(chan error, 1)
+		go func() { served <- listener.ServeDefault(&http.Server{Handler: handler}) }()
+
+		client.CloseIdleConnections()
+		resp, err := client.Get("https://127.0.0.1:6144")
+		Expect(err).To(BeNil())
+		resp.Body.Close()
+
+		client.CloseIdleConnections()
+		listener.Stop()
+		Eventually(served).Should(Receive(Equal(http.ErrServerClosed)))
+	})
+})
+
+var _ = Describe("Accept capacity", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+
+	var canAccept atomic.Bool
+	listener := &Listener{
+		BindAddr:          "127.0.0.1:6145",
+		CanAccept:         canAccept.Load,
+		CanAcceptInterval: 10 * time.Millisecond,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should only accept connections while there is capacity", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:6145")
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		Consistently(listener.inFlight.Load, 100*time.Millisecond).Should(Equal(int64(0)))
+
+		canAccept.Store(true)
+		Eventually(listener.inFlight.Load).Should(Equal(int64(1)))
+	})
+})
+
+// collectingRegisterer is a MetricsRegisterer
+// that keeps the collect function it's given
+type collectingRegisterer struct {
+	collect func() []Metric
+}
+
+func (registerer *collectingRegisterer) Register(collect func() []Metric) error {
+	registerer.collect = collect
+	return nil
+}
+
+var _ = Describe("Metrics", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:         "127.0.0.1:6146",
+		HandshakeTimeout: 50 * time.Millisecond,
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should sample the listener's metrics when collected", func() {
+		registerer := &collectingRegisterer{}
+		Expect(listener.RegisterMetrics(registerer)).To(Succeed())
+
+		_, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6146", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		idleConn, err := net.Dial("tcp", "127.0.0.1:6146")
+		Expect(err).To(BeNil())
+		defer idleConn.Close()
+
+		Eventually(func() uint64 { return listener.Stats().HandshakeErrors }).Should(Equal(uint64(1)))
+
+		metrics := map[string]Metric{}
+		for _, metric := range registerer.collect() {
+			metrics[metric.Name+metric.Labels["protocol"]+metric.Labels["listener"]] = metric
+		}
+
+		Expect(metrics["tlsprotocol_handshakes_totalh2"].Value).To(Equal(float64(1)))
+		Expect(metrics["tlsprotocol_handshake_errors_total"].Value).To(Equal(float64(1)))
+		Expect(metrics["tlsprotocol_handshake_duration_seconds"].Type).To(Equal(MetricHistogram))
+		Expect(metrics["tlsprotocol_handshake_duration_seconds"].Count).To(Equal(uint64(1)))
+		Expect(metrics["tlsprotocol_handshake_duration_seconds"].Buckets[1]).To(Equal(uint64(1)))
+		Expect(metrics["tlsprotocol_queue_depthh2"].Value).To(Equal(float64(1)))
+		Expect(metrics["tlsprotocol_queue_depthdefault"].Value).To(Equal(float64(0)))
+	})
+})
+
+var _ = Describe("Lifetime connections", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:         "127.0.0.1:6147",
+		BufferSize:       2,
+		MaxLifetimeConns: 2,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should stop once the limit of connections has been delivered", func() {
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		for i := 0; i < 2; i++ {
+			Expect(listener.LifetimeConnsReached()).To(BeFalse())
+
+			conn, err := tls.Dial("tcp", "127.0.0.1:6147", &tls.Config{InsecureSkipVerify: true})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+
+			Eventually(listener.LifetimeConnsReached).Should(Equal(i == 1))
+		}
+
+		Consistently(listener.Done()).ShouldNot(BeClosed())
+
+		for i := 0; i < 2; i++ {
+			serverConn, err := listener.Accept()
+			Expect(err).To(BeNil())
+			serverConn.Close()
+		}
+
+		Eventually(listener.Done()).Should(BeClosed())
+
+		_, err := net.Dial("tcp", "127.0.0.1:6147")
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Mutual ALPN", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:   "127.0.0.1:6151",
+		BufferSize: 2,
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	// Go always negotiates a mutual protocol, so the
+	// handshake's state is built to route a connection
+	// that negotiated one the client didn't offer
+	routeNonMutual := func() {
+		_, server := net.Pipe()
+		tracked := newConn(server, 1, 0)
+		listener.route(tls.Server(tracked, listener.TLSConfig), tracked, tls.ConnectionState{NegotiatedProtocol: "h2"})
+	}
+
+	It("Should deliver connections without a mutual protocol to the default listener", func() {
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		routeNonMutual()
+
+		Expect(h2Listener.(*Protocol).channel).To(BeEmpty())
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+
+	It("Should deliver connections without a mutual protocol to the Protocol listener with IgnoreMutualALPN", func() {
+		listener.IgnoreMutualALPN = true
+		defer func() { listener.IgnoreMutualALPN = false }()
+
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		routeNonMutual()
+
+		Expect(listener.defaultChannel).To(BeEmpty())
+		serverConn, err := h2Listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
@@ -0,0 +1,130 @@
+package tlsprotocol
+
+import (
+	"sort"
+)
+
+// MetricType is the kind of value a Metric holds
+type MetricType int
+
+const (
+	// MetricCounter is a value that only goes up,
+	// until ResetStats() is called
+	MetricCounter MetricType = iota
+
+	// MetricGauge is a value that can go up and down
+	MetricGauge
+
+	// MetricHistogram is a distribution of observations,
+	// its value is the sum of the observations
+	MetricHistogram
+)
+
+// Metric is a sample of one of the listener's metrics,
+// named and typed the way Prometheus expects so an
+// adapter only has to translate it (i.e. with
+// prometheus.MustNewConstMetric or MustNewConstHistogram)
+type Metric struct {
+	Name   string
+	Help   string
+	Type   MetricType
+	Labels map[string]string
+	Value  float64
+
+	// Buckets are the cumulative counts of a histogram's
+	// observations keyed by the bucket's upper bound and
+	// Count is the total number of observations
+	Buckets map[float64]uint64
+	Count   uint64
+}
+
+// MetricsRegisterer is implemented by an adapter for a
+// metrics library, so the package doesn't depend on any.
+// Register is called once with a function that samples the
+// listener's metrics, the adapter calls it every time the
+// metrics are collected (i.e. from the Collect() method of
+// a prometheus.Collector)
+type MetricsRegisterer interface {
+	Register(collect func() []Metric) error
+}
+
+// RegisterMetrics registers the listener's metrics with
+// the registerer, they're sampled from Stats() when collected:
+//
+//   - tlsprotocol_handshakes_total, a counter of completed
+//     handshakes labelled by the negotiated ALPN `protocol`
+//   - tlsprotocol_handshake_errors_total, a counter of
+//     failed handshakes
+//   - tlsprotocol_handshake_duration_seconds, a histogram
+//     of how long completed handshakes took
+//   - tlsprotocol_queue_depth, a gauge of the connections
+//     queued in each channel labelled by `listener`
+//
+// ResetStats() resets the counters and the histogram
+func (listener *Listener) RegisterMetrics(registerer MetricsRegisterer) error {
+	return registerer.Register(listener.metrics)
+}
+
+// metrics samples the listener's metrics from Stats()
+func (listener *Listener) metrics() []Metric {
+	stats := listener.Stats()
+	metrics := make([]Metric, 0, len(stats.Protocols)+len(stats.Queues)+2)
+
+	protocols := make([]string, 0, len(stats.Protocols))
+	for proto := range stats.Protocols {
+		protocols = append(protocols, proto)
+	}
+	sort.Strings(protocols)
+
+	for _, proto := range protocols {
+		metrics = append(metrics, Metric{
+			Name:   "tlsprotocol_handshakes_total",
+			Help:   "Number of completed TLS handshakes by negotiated ALPN protocol.",
+			Type:   MetricCounter,
+			Labels: map[string]string{"protocol": proto},
+			Value:  float64(stats.Protocols[proto]),
+		})
+	}
+
+	metrics = append(metrics, Metric{
+		Name:  "tlsprotocol_handshake_errors_total",
+		Help:  "Number of accepted connections whose TLS handshake failed.",
+		Type:  MetricCounter,
+		Value: float64(stats.HandshakeErrors),
+	})
+
+	histogram := Metric{
+		Name:    "tlsprotocol_handshake_duration_seconds",
+		Help:    "How long completed TLS handshakes took.",
+		Type:    MetricHistogram,
+		Value:   stats.HandshakeDurationTotal.Seconds(),
+		Buckets: make(map[float64]uint64, len(HandshakeDurationBuckets)),
+	}
+
+	for i := range stats.HandshakeDurations {
+		histogram.Count += stats.HandshakeDurations[i]
+		if i < len(HandshakeDurationBuckets) {
+			histogram.Buckets[HandshakeDurationBuckets[i].Seconds()] = histogram.Count
+		}
+	}
+
+	metrics = append(metrics, histogram)
+
+	names := make([]string, 0, len(stats.Queues))
+	for name := range stats.Queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		metrics = append(metrics, Metric{
+			Name:   "tlsprotocol_queue_depth",
+			Help:   "Number of connections queued in the channel of a listener.",
+			Type:   MetricGauge,
+			Labels: map[string]string{"listener": name},
+			Value:  float64(stats.Queues[name].Depth),
+		})
+	}
+
+	return metrics
+}
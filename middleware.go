@@ -0,0 +1,69 @@
+package tlsprotocol
+
+import (
+	"net"
+)
+
+// Middleware is called with each connection before
+// it's delivered, it can return the connection as is,
+// return a wrapped connection or return an error to
+// have the connection closed instead of delivered
+type Middleware func(net.Conn) (net.Conn, error)
+
+// Use appends the middleware to the chain that every
+// connection passes through before it's delivered, the
+// middleware are called in the order they were added
+func (listener *Listener) Use(middleware Middleware) {
+	listener.stateLock.Lock()
+	defer listener.stateLock.Unlock()
+
+	chain := make([]Middleware, len(listener.middleware), len(listener.middleware)+1)
+	copy(chain, listener.middleware)
+	listener.middleware = append(chain, middleware)
+}
+
+// applyMiddleware passes the connection through
+// the middleware chain stopping at the first error
+func (listener *Listener) applyMiddleware(conn net.Conn) (net.Conn, error) {
+	listener.stateLock.Lock()
+	chain := listener.middleware
+	listener.stateLock.Unlock()
+
+	return applyChain(chain, conn)
+}
+
+// applyChain passes the connection through the
+// middleware in order stopping at the first error
+func applyChain(chain []Middleware, conn net.Conn) (net.Conn, error) {
+	for i := range chain {
+		var err error
+		if conn, err = chain[i](conn); err != nil {
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// Use appends the middleware to the chain that the
+// connections routed to the Protocol pass through, it
+// runs after the Listener's chain and the middleware
+// are called in the order they were added
+func (protocol *Protocol) Use(middleware Middleware) {
+	protocol.middlewareLock.Lock()
+	defer protocol.middlewareLock.Unlock()
+
+	chain := make([]Middleware, len(protocol.middleware), len(protocol.middleware)+1)
+	copy(chain, protocol.middleware)
+	protocol.middleware = append(chain, middleware)
+}
+
+// applyMiddleware passes the connection through the
+// Protocol's middleware chain stopping at the first error
+func (protocol *Protocol) applyMiddleware(conn net.Conn) (net.Conn, error) {
+	protocol.middlewareLock.Lock()
+	chain := protocol.middleware
+	protocol.middlewareLock.Unlock()
+
+	return applyChain(chain, conn)
+}
@@ -0,0 +1,301 @@
+package tlsprotocol
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Multiplexer manages several Listeners (i.e. for
+// different ports or TLS configurations) as one,
+// connections and errors from every Listener are
+// merged into a single Accept() and a single Stop()
+// shuts them all down
+type Multiplexer struct {
+	// Listeners are the Listeners managed by
+	// the Multiplexer, they must not be started
+	// or stopped directly
+	Listeners []*Listener
+
+	// protocols are the merged Protocol listeners
+	// keyed by their ALPN Protocol
+	protocols map[string]*multiplexed
+
+	// defaults merges the default channels
+	// and errors of every Listener
+	defaults *multiplexed
+
+	// stopping is closed by Stop() so forwarders
+	// blocked on a consumer give up their connection
+	stopping chan struct{}
+	stopped  bool
+}
+
+// multiplexed is a net.Listener that receives
+// the connections forwarded from a channel of
+// each of the Multiplexer's Listeners
+type multiplexed struct {
+	addr    net.Addr
+	conns   chan net.Conn
+	errors  chan error
+	sources []*Protocol
+
+	// forwarders tracks the go routines forwarding
+	// connections, conns is closed once they exit
+	forwarders sync.WaitGroup
+
+	// done is closed by Close() so Accept fails and
+	// forwarded connections are closed
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Start starts every Listener, if any Listener fails
+// to start the Listeners already started are stopped.
+// A Multiplexer can only be started once
+func (multiplexer *Multiplexer) Start() error {
+	if multiplexer.defaults != nil {
+		return fmt.Errorf("multiplexer already started")
+	}
+
+	if len(multiplexer.Listeners) == 0 {
+		return fmt.Errorf("multiplexer has no listeners")
+	}
+
+	for i := range multiplexer.Listeners {
+		if err := multiplexer.Listeners[i].Start(); err != nil {
+			for j := 0; j < i; j++ {
+				multiplexer.Listeners[j].Stop()
+			}
+
+			return fmt.Errorf("start listener %s: %w", multiplexer.Listeners[i].BindAddr, err)
+		}
+	}
+
+	multiplexer.stopping = make(chan struct{})
+	multiplexer.defaults = newMultiplexed(multiplexer.Listeners[0].Addr())
+
+	for i := range multiplexer.Listeners {
+		multiplexer.defaults.forwarders.Add(1)
+		go multiplexer.forwardDefault(multiplexer.Listeners[i])
+	}
+
+	go multiplexer.defaults.closeOnceForwarded()
+
+	for _, protocol := range multiplexer.protocols {
+		protocol.addr = multiplexer.Listeners[0].Addr()
+		if len(protocol.sources) > 0 {
+			protocol.addr = protocol.sources[0].Addr()
+		}
+
+		for i := range protocol.sources {
+			protocol.forwarders.Add(1)
+			go multiplexer.forward(protocol, protocol.sources[i])
+		}
+
+		go protocol.closeOnceForwarded()
+	}
+
+	return nil
+}
+
+// Protocol setups a net.Listener that receives the TLS
+// connections matching the ALPN Protocol from every
+// Listener, it must be called before Start()
+func (multiplexer *Multiplexer) Protocol(proto string) (net.Listener, error) {
+	if multiplexer.defaults != nil {
+		return nil, fmt.Errorf("protocol listener must be created before starting multiplexer")
+	}
+
+	if _, exists := multiplexer.protocols[proto]; exists {
+		return nil, fmt.Errorf("protocol listener already declared for proto: %s", proto)
+	}
+
+	merged := newMultiplexed(nil)
+	for i := range multiplexer.Listeners {
+		protocol, err := multiplexer.Listeners[i].Protocol(proto)
+		if err != nil {
+			for j := range merged.sources {
+				merged.sources[j].Close()
+			}
+
+			return nil, fmt.Errorf("listener %s: %w", multiplexer.Listeners[i].BindAddr, err)
+		}
+
+		merged.sources = append(merged.sources, protocol.(*Protocol))
+	}
+
+	if multiplexer.protocols == nil {
+		multiplexer.protocols = make(map[string]*multiplexed)
+	}
+
+	multiplexer.protocols[proto] = merged
+	return merged, nil
+}
+
+// Accept will receive the connections from the
+// default channel of every Listener, it also
+// receives the fatal errors of every Listener,
+// see Listener's Accept()
+func (multiplexer *Multiplexer) Accept() (net.Conn, error) {
+	if multiplexer.defaults == nil {
+		return nil, fmt.Errorf("multiplexer not started")
+	}
+
+	return multiplexer.defaults.Accept()
+}
+
+// Addr returns the address of the
+// first of the Multiplexer's Listeners
+func (multiplexer *Multiplexer) Addr() net.Addr {
+	if len(multiplexer.Listeners) == 0 {
+		return nil
+	}
+
+	return multiplexer.Listeners[0].Addr()
+}
+
+// Addrs returns the addresses of
+// all of the Multiplexer's Listeners
+func (multiplexer *Multiplexer) Addrs() []net.Addr {
+	var addrs []net.Addr
+	for i := range multiplexer.Listeners {
+		addrs = append(addrs, multiplexer.Listeners[i].Addrs()...)
+	}
+
+	return addrs
+}
+
+// Close calls the Stop() function
+// of the Multiplexer
+func (multiplexer *Multiplexer) Close() error {
+	multiplexer.Stop()
+	return nil
+}
+
+// Stop stops every Listener, connections waiting
+// to be accepted are closed and the merged listeners
+// are closed once every Listener has stopped
+func (multiplexer *Multiplexer) Stop() {
+	if multiplexer.defaults == nil || multiplexer.stopped {
+		return
+	}
+
+	multiplexer.stopped = true
+	close(multiplexer.stopping)
+
+	for i := range multiplexer.Listeners {
+		multiplexer.Listeners[i].Stop()
+	}
+}
+
+// forwardDefault forwards the connections and fatal
+// errors of the Listener until its default channel
+// is closed
+func (multiplexer *Multiplexer) forwardDefault(listener *Listener) {
+	defer multiplexer.defaults.forwarders.Done()
+
+	defaultChannel, errors := listener.defaultChannel, listener.fatal
+	for {
+		select {
+		case conn, ok := <-defaultChannel:
+			if !ok {
+				return
+			}
+
+			multiplexer.send(multiplexer.defaults, conn)
+
+		case err := <-errors:
+			select {
+			case multiplexer.defaults.errors <- err:
+			case <-multiplexer.defaults.done:
+			case <-multiplexer.stopping:
+			}
+		}
+	}
+}
+
+// forward forwards the connections of a Listener's
+// Protocol until the Protocol's channel is closed
+func (multiplexer *Multiplexer) forward(merged *multiplexed, protocol *Protocol) {
+	defer merged.forwarders.Done()
+
+	for conn := range protocol.channel {
+		multiplexer.send(merged, conn)
+	}
+}
+
+// send hands the connection to the merged listener's
+// consumer, if the Multiplexer stops or the merged
+// listener is closed first the connection is closed
+func (multiplexer *Multiplexer) send(merged *multiplexed, conn net.Conn) {
+	select {
+	case merged.conns <- conn:
+	case <-merged.done:
+		conn.Close()
+	case <-multiplexer.stopping:
+		conn.Close()
+	}
+}
+
+// newMultiplexed creates a merged
+// listener reporting the address
+func newMultiplexed(addr net.Addr) *multiplexed {
+	return &multiplexed{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		errors: make(chan error),
+		done:   make(chan struct{}),
+	}
+}
+
+// closeOnceForwarded closes the merged listener's
+// channel once all of its forwarders have exited
+func (merged *multiplexed) closeOnceForwarded() {
+	merged.forwarders.Wait()
+	close(merged.conns)
+}
+
+// Accept will block until a connection is
+// forwarded by one of the Listeners
+func (merged *multiplexed) Accept() (net.Conn, error) {
+	select {
+	case <-merged.done:
+		return nil, &net.OpError{Op: "accept", Net: merged.addr.Network(), Addr: merged.addr, Err: net.ErrClosed}
+	default:
+	}
+
+	select {
+	case <-merged.done:
+		return nil, &net.OpError{Op: "accept", Net: merged.addr.Network(), Addr: merged.addr, Err: net.ErrClosed}
+
+	case conn, ok := <-merged.conns:
+		if !ok {
+			return nil, fmt.Errorf("accept %s %s: use of closed network connection", merged.addr.Network(), merged.addr.String())
+		}
+
+		return conn, nil
+
+	case err := <-merged.errors:
+		return nil, err
+	}
+}
+
+// Close stops the merged listener accepting, Accept
+// fails with net.ErrClosed from then on and the
+// connections forwarded to it are closed. It doesn't
+// stop the Multiplexer's Listeners, which keep
+// negotiating the protocol until Stop() is called
+func (merged *multiplexed) Close() error {
+	merged.closeOnce.Do(func() {
+		close(merged.done)
+	})
+
+	return nil
+}
+
+// Addr returns the address of the
+// first Listener's listener
+func (merged *multiplexed) Addr() net.Addr {
+	return merged.addr
+}
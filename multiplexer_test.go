@@ -0,0 +1,119 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+)
+
+var _ = Describe("Multiplexer", func() {
+	var h2Listener net.Listener
+
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	newListener := func(bindAddr string) *Listener {
+		return &Listener{
+			BindAddr: bindAddr,
+			TLSConfig: &tls.Config{
+				NextProtos:   []string{"h2"},
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+	}
+
+	multiplexer := &Multiplexer{
+		Listeners: []*Listener{newListener("127.0.0.1:6103"), newListener("127.0.0.1:6104")},
+	}
+
+	It("Should register the protocol on every listener", func() {
+		var err error
+		h2Listener, err = multiplexer.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		for _, listener := range multiplexer.Listeners {
+			Expect(listener.channels).To(HaveKey("h2"))
+		}
+
+		Expect(multiplexer.Start()).To(BeNil())
+		Expect(multiplexer.Addrs()).To(HaveLen(2))
+	})
+
+	It("Should merge the connections of every listener", func() {
+		for _, addr := range []string{"127.0.0.1:6103", "127.0.0.1:6104"} {
+			conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+
+			serverConn, err := multiplexer.Accept()
+			Expect(err).To(BeNil())
+			Expect(serverConn.LocalAddr().String()).To(Equal(addr))
+			serverConn.Close()
+
+			conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+
+			serverConn, err = h2Listener.Accept()
+			Expect(err).To(BeNil())
+			Expect(serverConn.LocalAddr().String()).To(Equal(addr))
+			serverConn.Close()
+		}
+	})
+
+	It("Should stop every listener", func() {
+		multiplexer.Stop()
+
+		for _, listener := range multiplexer.Listeners {
+			Eventually(listener.Done()).Should(BeClosed())
+		}
+
+		_, err := multiplexer.Accept()
+		Expect(err).ToNot(BeNil())
+
+		_, err = h2Listener.Accept()
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Multiplexed protocol listener", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	multiplexer := &Multiplexer{
+		Listeners: []*Listener{{
+			BindAddr: "127.0.0.1:6150",
+			TLSConfig: &tls.Config{
+				NextProtos:   []string{"h2"},
+				Certificates: []tls.Certificate{cert},
+			},
+		}},
+	}
+
+	It("Should stop accepting once closed without stopping the listeners", func() {
+		h2Listener, err := multiplexer.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		Expect(multiplexer.Start()).To(BeNil())
+		defer multiplexer.Stop()
+
+		Expect(h2Listener.Close()).To(Succeed())
+		Expect(h2Listener.Close()).To(Succeed())
+
+		_, err = h2Listener.Accept()
+		Expect(err).To(MatchError(net.ErrClosed))
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6150", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:6150", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := multiplexer.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+	})
+})
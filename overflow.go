@@ -0,0 +1,25 @@
+package tlsprotocol
+
+// OverflowPolicy decides what happens to a
+// connection when the channel it's being
+// delivered to is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until there is room
+	// in the channel, this is the default
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropNewest closes the connection
+	// being delivered
+	OverflowDropNewest
+
+	// OverflowDropOldest closes the connection
+	// that has been queued the longest to make
+	// room for the connection being delivered
+	OverflowDropOldest
+
+	// OverflowReject closes the connection being
+	// delivered and reports an error via Errors()
+	OverflowReject
+)
@@ -0,0 +1,164 @@
+package tlsprotocol
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+)
+
+// priorityStarvationLimit is how many connections in
+// a row AcceptPriority() returns from higher priority
+// listeners while a lower priority listener has
+// connections waiting before it returns one of them
+const priorityStarvationLimit = 16
+
+// priorityQueue is a channel AcceptPriority()
+// receives from and the priority of its listener
+type priorityQueue struct {
+	name     string
+	priority int
+	channel  chan net.Conn
+}
+
+// ProtocolWithPriority setups a net.Listener to receive
+// all TLS connections that match the ALPN Protocol, with
+// the priority AcceptPriority() gives the connections
+// queued for it. Protocols without a priority and the
+// default listener have a priority of 0
+func (listener *Listener) ProtocolWithPriority(proto string, priority int) (net.Listener, error) {
+	protocol, err := listener.Protocol(proto)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol.(*Protocol).priority = priority
+	return protocol, nil
+}
+
+// AcceptPriority waits for and returns the next connection
+// queued for the default listener or any of the ALPN Protocol
+// listeners, when several are queued the connection of the
+// listener with the highest priority is returned first so a
+// single consumer can handle mixed traffic in order of
+// importance. Listeners of the same priority are taken in
+// order of name, "default" for the default listener.
+//
+// Lower priority listeners aren't starved by sustained load
+// on a higher priority one, once priorityStarvationLimit (16)
+// connections in a row have been returned while a listener
+// later in the order had connections waiting, the next is
+// taken from the first of those listeners instead.
+//
+// It competes with the consumers of the Protocol listeners,
+// a connection is only returned by one of them
+func (listener *Listener) AcceptPriority() (net.Conn, error) {
+	for {
+		queues := listener.priorityQueues()
+		if queues == nil {
+			return nil, fmt.Errorf("listener must be started before accepting")
+		}
+
+		if next := listener.nextPriorityQueue(queues); next >= 0 {
+			select {
+			case conn, ok := <-queues[next].channel:
+				if ok {
+					return conn, nil
+				}
+			default:
+			}
+
+			// another consumer took the connection or the
+			// Protocol listener was closed, so look again
+			continue
+		}
+
+		cases := make([]reflect.SelectCase, 0, len(queues)+1)
+		for i := range queues {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(queues[i].channel)})
+		}
+
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(listener.fatal)})
+
+		chosen, value, ok := reflect.Select(cases)
+		switch {
+		case chosen == len(queues):
+			return nil, value.Interface().(error)
+
+		case ok:
+			return value.Interface().(net.Conn), nil
+
+		case queues[chosen].channel == listener.defaultChannel:
+			return nil, fmt.Errorf("accept %s %s: use of closed network connection", listener.addr.Network(), listener.addr.String())
+		}
+
+		// a Protocol listener was closed, it's no
+		// longer registered so the queues are rebuilt
+	}
+}
+
+// nextPriorityQueue returns the index of the queue
+// AcceptPriority() should take a connection from, the
+// first with a connection waiting unless the queues after
+// it have been passed over priorityStarvationLimit times in
+// a row, or -1 if no connection is waiting in any queue
+func (listener *Listener) nextPriorityQueue(queues []priorityQueue) int {
+	first, later := -1, -1
+	for i := range queues {
+		if len(queues[i].channel) == 0 {
+			continue
+		}
+
+		if first < 0 {
+			first = i
+		} else {
+			later = i
+			break
+		}
+	}
+
+	listener.priorityLock.Lock()
+	defer listener.priorityLock.Unlock()
+
+	switch {
+	case later < 0:
+		listener.priorityPassed = 0
+		return first
+
+	case listener.priorityPassed >= priorityStarvationLimit:
+		listener.priorityPassed = 0
+		return later
+
+	default:
+		listener.priorityPassed++
+		return first
+	}
+}
+
+// priorityQueues returns the channels of the default
+// listener and the ALPN Protocol listeners ordered by
+// priority, nil if the listener hasn't been started
+func (listener *Listener) priorityQueues() []priorityQueue {
+	if listener.defaultChannel == nil {
+		return nil
+	}
+
+	listener.channelsLock.RLock()
+	queues := make([]priorityQueue, 0, len(listener.channels)+1)
+	for proto, protocol := range listener.channels {
+		queues = append(queues, priorityQueue{name: proto, priority: protocol.priority, channel: protocol.channel})
+	}
+	listener.channelsLock.RUnlock()
+
+	queues = append(queues, priorityQueue{name: "default", channel: listener.defaultChannel})
+
+	sort.Slice(queues, func(i, j int) bool {
+		if queues[i].priority != queues[j].priority {
+			return queues[i].priority > queues[j].priority
+		}
+
+		return queues[i].name < queues[j].name
+	})
+
+	return queues
+}
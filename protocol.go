@@ -1,18 +1,121 @@
 package tlsprotocol
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Protocol is a `net.Listener` interface
 // that receives connections from the parent
 // listener for the specific ALPN Protocol
-// configured
+// configured.
+//
+// Every connection delivered by a Protocol listener
+// for an ALPN Protocol negotiated exactly Name(), unless
+// another Protocol was closed to it with CloseTo(). The
+// plaintext and drain listeners have no name and their
+// connections can have negotiated any protocol, Conn's
+// Proto() returns what a connection negotiated
 type Protocol struct {
 	parent  *Listener
 	proto   string
 	channel chan net.Conn
+
+	// clientAuth, if set, overrides the client
+	// authentication policy of handshakes that
+	// will negotiate the Protocol
+	clientAuth *tls.ClientAuthType
+
+	// requireClientCert, if set, has connections
+	// without a verified client certificate closed
+	// rather than delivered
+	requireClientCert bool
+
+	// handshakeTimeout, if set, overrides the
+	// listener's HandshakeTimeout once the
+	// ClientHello shows the handshake will
+	// negotiate the Protocol
+	handshakeTimeout time.Duration
+
+	// onFull, if set, overrides the listener's
+	// OnFull policy for the Protocol's channel
+	onFull *OverflowPolicy
+
+	// getCertificate, if set, selects the certificate
+	// for handshakes that will negotiate the Protocol
+	// in place of the TLS configuration's certificates
+	getCertificate func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// priority orders the Protocol's connections
+	// against those of the other listeners for
+	// AcceptPriority(), higher is taken first
+	priority int
+
+	// rejectEarlyData, if set, clears the early
+	// data flag of session tickets issued by
+	// handshakes that will negotiate the Protocol
+	rejectEarlyData bool
+
+	// closing is closed when the Protocol starts
+	// closing so deliveries waiting for room in the
+	// channel route their connection again, senders
+	// tracks those deliveries so channel is only
+	// closed once they have finished
+	closing chan struct{}
+	senders sync.WaitGroup
+
+	// middleware is the chain registered via
+	// Use(), it is replaced rather than modified
+	// and is guarded by middlewareLock
+	middleware     []Middleware
+	middlewareLock sync.Mutex
+
+	// consumers are the channels registered via
+	// AddConsumer() that connections are dispatched
+	// to in turn, guarded by consumersLock
+	consumers       []chan net.Conn
+	consumersClosed bool
+	consumersLock   sync.Mutex
+
+	// dispatcher tracks the dispatch go routine,
+	// dispatching counts the connection it has
+	// taken from the channel but not yet sent
+	// to a consumer
+	dispatcher  sync.WaitGroup
+	dispatching atomic.Int64
+}
+
+// newProtocol creates a Protocol listener
+// with a channel buffering `size` connections
+func newProtocol(parent *Listener, proto string, size int) *Protocol {
+	return &Protocol{
+		parent:  parent,
+		proto:   proto,
+		channel: make(chan net.Conn, size),
+		closing: make(chan struct{}),
+	}
+}
+
+// overflowPolicy returns the policy followed
+// when the Protocol's channel is full
+func (protocol *Protocol) overflowPolicy() OverflowPolicy {
+	if protocol.onFull != nil {
+		return *protocol.onFull
+	}
+
+	return protocol.parent.OnFull
+}
+
+// Name returns the ALPN Protocol the Protocol
+// listener receives connections for, it is empty
+// for the plaintext and drain listeners
+func (protocol *Protocol) Name() string {
+	return protocol.proto
 }
 
 // Accept will block until a new connection
@@ -25,6 +128,155 @@ func (protocol *Protocol) Accept() (net.Conn, error) {
 	}
 }
 
+// AcceptTLS is Accept() returning the TLS connection,
+// a connection wrapped by middleware is unwrapped to its
+// *tls.Conn through `NetConn()`, like ConnFrom, so reads and
+// writes on it bypass the wrapper. If there is no TLS
+// connection (i.e. a plaintext connection) it's closed
+// and an error is returned
+func (protocol *Protocol) AcceptTLS() (*tls.Conn, error) {
+	return acceptTLS(protocol)
+}
+
+// AddConsumer registers a new consumer of the
+// Protocol's connections and returns the channel
+// it will receive them on.
+//
+// Once a consumer has been added the Protocol will
+// dispatch connections to each consumer in turn and
+// Accept() should no longer be used, the consumer
+// channels are closed when the Protocol is closed.
+//
+// Each consumer buffers up to the listener's BufferSize
+// connections, a consumer whose channel is full is skipped
+// so a slow consumer doesn't hold up the others. When the
+// listener stops the connections still buffered for the
+// consumers are closed.
+func (protocol *Protocol) AddConsumer() <-chan net.Conn {
+	protocol.consumersLock.Lock()
+	defer protocol.consumersLock.Unlock()
+
+	consumer := make(chan net.Conn, cap(protocol.channel))
+	if protocol.consumersClosed {
+		close(consumer)
+		return consumer
+	}
+
+	protocol.consumers = append(protocol.consumers, consumer)
+
+	if len(protocol.consumers) == 1 {
+		protocol.dispatcher.Add(1)
+		go protocol.dispatch()
+	}
+
+	return consumer
+}
+
+// dispatch receives connections from the Protocol's
+// channel and sends them to the registered consumers
+// in a round-robin order until the channel is closed
+func (protocol *Protocol) dispatch() {
+	defer protocol.dispatcher.Done()
+
+	next := 0
+	for conn := range protocol.channel {
+		protocol.dispatching.Add(1)
+
+		protocol.consumersLock.Lock()
+		consumers := protocol.consumers
+		protocol.consumersLock.Unlock()
+
+		if sent := protocol.sendToConsumer(consumers, next, conn); sent >= 0 {
+			next = sent + 1
+		} else {
+			conn.Close()
+
+			select {
+			case <-protocol.parent.stopping:
+				protocol.parent.forceClosed.Add(1)
+			default:
+			}
+		}
+
+		protocol.dispatching.Add(-1)
+	}
+
+	protocol.consumersLock.Lock()
+	defer protocol.consumersLock.Unlock()
+
+	for i := range protocol.consumers {
+		close(protocol.consumers[i])
+	}
+
+	protocol.consumersClosed = true
+}
+
+// sendToConsumer sends the connection to the first
+// consumer with room in its channel, trying them in
+// turn from `next`. If every consumer is full it waits
+// for any of them to have room, it returns the index of
+// the consumer or -1 if the Protocol or the listener
+// started closing first
+func (protocol *Protocol) sendToConsumer(consumers []chan net.Conn, next int, conn net.Conn) int {
+	for i := range consumers {
+		index := (next + i) % len(consumers)
+
+		select {
+		case consumers[index] <- conn:
+			return index
+		default:
+		}
+	}
+
+	cases := make([]reflect.SelectCase, 0, len(consumers)+2)
+	for i := range consumers {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(consumers[i]), Send: reflect.ValueOf(conn)})
+	}
+
+	cases = append(cases,
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(protocol.parent.stopping)},
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(protocol.closing)},
+	)
+
+	if chosen, _, _ := reflect.Select(cases); chosen < len(consumers) {
+		return chosen
+	}
+
+	return -1
+}
+
+// consumersBacklog returns the number of connections
+// buffered for the consumers or held by the dispatch
+// go routine waiting for one of them to have room
+func (protocol *Protocol) consumersBacklog() int {
+	protocol.consumersLock.Lock()
+	defer protocol.consumersLock.Unlock()
+
+	backlog := int(protocol.dispatching.Load())
+	for i := range protocol.consumers {
+		backlog += len(protocol.consumers[i])
+	}
+
+	return backlog
+}
+
+// takeConsumersQueued waits for the dispatch go routine
+// to finish, once the Protocol has been closed, and then
+// removes the connections buffered for the consumers
+func (protocol *Protocol) takeConsumersQueued() []net.Conn {
+	protocol.dispatcher.Wait()
+
+	protocol.consumersLock.Lock()
+	defer protocol.consumersLock.Unlock()
+
+	var queued []net.Conn
+	for i := range protocol.consumers {
+		queued = append(queued, takeQueued(protocol.consumers[i])...)
+	}
+
+	return queued
+}
+
 // Close will close the Protocol's channel
 // so it can't receive any more connections
 // and will remove itself from the parent Listener.
@@ -33,17 +285,88 @@ func (protocol *Protocol) Accept() (net.Conn, error) {
 // connections for it's ALPN Protocol will be directed
 // to the default channel.
 func (protocol *Protocol) Close() error {
-	if _, ok := protocol.parent.channels[protocol.proto]; ok {
-		close(protocol.channel)
-		delete(protocol.parent.channels, protocol.proto)
-		return nil
+	if !protocol.parent.removeProtocol(protocol) {
+		return fmt.Errorf("listener already closed")
 	}
 
-	return fmt.Errorf("listener already closed")
+	protocol.closeChannel()
+	return nil
+}
+
+// CloseTo closes the Protocol like Close() but hands
+// its traffic over to another Protocol listener of the
+// same parent Listener, connections for the Protocol's
+// ALPN Protocol are delivered to `other` from then on.
+//
+// Connections still waiting in the Protocol's channel
+// and those being delivered to it while it closes are
+// moved to `other` rather than lost. If `other` is
+// closed later the connections for both ALPN Protocols
+// are directed to the default channel.
+func (protocol *Protocol) CloseTo(other *Protocol) error {
+	if protocol.proto == "" {
+		return fmt.Errorf("only ALPN Protocol listeners can be closed to another listener")
+	}
+
+	if other == nil || other == protocol || other.parent != protocol.parent {
+		return fmt.Errorf("protocol listener can only be closed to another protocol listener of the same listener")
+	}
+
+	if err := protocol.parent.redirectProtocol(protocol, other); err != nil {
+		return err
+	}
+
+	close(protocol.closing)
+	protocol.senders.Wait()
+
+	for _, conn := range takeQueued(protocol.channel) {
+		select {
+		case other.channel <- conn:
+		case <-other.closing:
+			conn.Close()
+		case <-protocol.parent.stopping:
+			conn.Close()
+		}
+	}
+
+	other.senders.Done()
+	close(protocol.channel)
+	return nil
+}
+
+// closeChannel closes the Protocol's channel once
+// the deliveries waiting for room in it have given up
+func (protocol *Protocol) closeChannel() {
+	close(protocol.closing)
+	protocol.senders.Wait()
+	close(protocol.channel)
 }
 
 // Addr returns the address the parent listener
-// is receiving connections on
+// is receiving connections on, wrapped in a
+// ProtocolAddr so it identifies the ALPN Protocol
 func (protocol *Protocol) Addr() net.Addr {
-	return protocol.parent.addr
+	if protocol.parent.addr == nil || protocol.proto == "" {
+		return protocol.parent.addr
+	}
+
+	return &ProtocolAddr{Addr: protocol.parent.addr, Proto: protocol.proto}
+}
+
+// ProtocolAddr is the address of a Protocol listener,
+// it is the parent listener's address with the ALPN
+// Protocol included in its string form (i.e. 127.0.0.1:443[h2])
+// so the listeners of different protocols can be told apart
+type ProtocolAddr struct {
+	net.Addr
+
+	// Proto is the ALPN Protocol
+	// of the Protocol listener
+	Proto string
+}
+
+// String returns the parent listener's address
+// followed by the ALPN Protocol in brackets
+func (addr *ProtocolAddr) String() string {
+	return fmt.Sprintf("%s[%s]", addr.Addr.String(), addr.Proto)
 }
@@ -0,0 +1,411 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net"
+	"time"
+)
+
+var _ = Describe("Protocol", func() {
+	var h2Listener net.Listener
+
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6083",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should dispatch connections to consumers in turn", func() {
+		var err error
+		h2Listener, err = listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		consumers := []<-chan net.Conn{
+			h2Listener.(*Protocol).AddConsumer(),
+			h2Listener.(*Protocol).AddConsumer(),
+		}
+
+		Expect(listener.Start()).To(BeNil())
+
+		for i := 0; i < 4; i++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6083", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+
+			serverConn := <-consumers[i%len(consumers)]
+			Expect(serverConn).ToNot(BeNil())
+			serverConn.Close()
+		}
+	})
+
+	It("Should close the consumers when the protocol is closed", func() {
+		consumer := h2Listener.(*Protocol).AddConsumer()
+		listener.Stop()
+
+		Eventually(consumer).Should(BeClosed())
+	})
+})
+
+var _ = Describe("Protocol consumers", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6152",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should skip a consumer that isn't receiving", func() {
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+
+		stalled := h2Listener.(*Protocol).AddConsumer()
+		consumers := []<-chan net.Conn{
+			h2Listener.(*Protocol).AddConsumer(),
+			h2Listener.(*Protocol).AddConsumer(),
+		}
+
+		Expect(listener.Start()).To(BeNil())
+
+		var clients []*tls.Conn
+		for i := 0; i < 6; i++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6152", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+			clients = append(clients, conn)
+
+			if i == 0 {
+				Eventually(func() int { return len(stalled) }).Should(Equal(1))
+				continue
+			}
+
+			var serverConn net.Conn
+			select {
+			case serverConn = <-consumers[0]:
+			case serverConn = <-consumers[1]:
+			case <-time.After(time.Second):
+			}
+
+			Expect(serverConn).ToNot(BeNil())
+			serverConn.Close()
+		}
+
+		Expect(listener.drained()).To(BeFalse())
+		Expect(listener.GracefulStop(50 * time.Millisecond)).To(Equal(1))
+		Eventually(stalled).Should(BeClosed())
+
+		_, err = clients[0].Read(make([]byte, 1))
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Typed accept", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6108",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should accept connections as TLS connections", func() {
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6108", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		tlsConn, err := h2Listener.(*Protocol).AcceptTLS()
+		Expect(err).To(BeNil())
+		Expect(tlsConn.ConnectionState().NegotiatedProtocol).To(Equal("h2"))
+		tlsConn.Close()
+
+		conn, err = tls.Dial("tcp", "127.0.0.1:6108", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		tlsConn, err = listener.AcceptTLS()
+		Expect(err).To(BeNil())
+		tlsConn.Close()
+	})
+
+	It("Should unwrap TLS connections wrapped by middleware", func() {
+		listener := &Listener{defaultChannel: make(chan net.Conn, 1)}
+
+		conn, peer := net.Pipe()
+		defer peer.Close()
+
+		tlsConn := tls.Server(conn, &tls.Config{})
+		listener.defaultChannel <- NewPrefixConn(tlsConn, nil)
+
+		accepted, err := listener.AcceptTLS()
+		Expect(err).To(BeNil())
+		Expect(accepted).To(Equal(tlsConn))
+	})
+
+	It("Should reject connections that aren't TLS connections", func() {
+		listener := &Listener{defaultChannel: make(chan net.Conn, 1)}
+
+		conn, peer := net.Pipe()
+		defer peer.Close()
+		listener.defaultChannel <- conn
+
+		_, err := listener.AcceptTLS()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("is not a TLS connection"))
+	})
+})
+
+var _ = Describe("Protocol matching", func() {
+	listener := &Listener{
+		TLSConfig: &tls.Config{
+			NextProtos: []string{"h2", "grpc", "http/1.1"},
+		},
+	}
+
+	It("Should match the protocol a client would be routed to", func() {
+		_, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+		_, err = listener.Protocol("grpc")
+		Expect(err).To(BeNil())
+
+		proto, matched := listener.WouldMatch([]string{"grpc", "h2"})
+		Expect(matched).To(BeTrue())
+		Expect(proto).To(Equal("h2"))
+
+		proto, matched = listener.WouldMatch([]string{"grpc"})
+		Expect(matched).To(BeTrue())
+		Expect(proto).To(Equal("grpc"))
+	})
+
+	It("Shouldn't match clients that would be routed to the default listener", func() {
+		_, matched := listener.WouldMatch([]string{"http/1.1"})
+		Expect(matched).To(BeFalse())
+
+		_, matched = listener.WouldMatch([]string{"spdy/3"})
+		Expect(matched).To(BeFalse())
+
+		_, matched = listener.WouldMatch(nil)
+		Expect(matched).To(BeFalse())
+	})
+})
+
+var _ = Describe("Protocol names", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:         "127.0.0.1:6122",
+		IgnoreMutualALPN: true,
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2", "http/1.1"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should deliver connections that negotiated the Protocol's name", func() {
+		h2Listener, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+		Expect(h2Listener.(*Protocol).Name()).To(Equal("h2"))
+
+		drainListener, err := listener.DrainListener()
+		Expect(err).To(BeNil())
+		Expect(drainListener.(*Protocol).Name()).To(BeEmpty())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6122", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1", "h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := h2Listener.Accept()
+		Expect(err).To(BeNil())
+		defer serverConn.Close()
+
+		tracked, ok := ConnFrom(serverConn)
+		Expect(ok).To(BeTrue())
+		Expect(tracked.Proto()).To(Equal(h2Listener.(*Protocol).Name()))
+		Expect(serverConn.(*tls.Conn).ConnectionState().NegotiatedProtocol).To(Equal("h2"))
+	})
+})
+
+var _ = Describe("Protocol handoff", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6128",
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2", "grpc"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should hand queued and new connections over to the other protocol", func() {
+		h2Listener, err := listener.ProtocolWithBacklog("h2", 1, OverflowBlock)
+		Expect(err).To(BeNil())
+
+		grpcListener, err := listener.ProtocolWithBacklog("grpc", 4, OverflowBlock)
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		for i := 0; i < 2; i++ {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6128", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+		}
+
+		Eventually(func() int { return len(h2Listener.(*Protocol).channel) }).Should(Equal(1))
+		Eventually(listener.inFlight.Load).Should(Equal(int64(1)))
+
+		Expect(h2Listener.(*Protocol).CloseTo(grpcListener.(*Protocol))).To(Succeed())
+		Expect(h2Listener.(*Protocol).CloseTo(grpcListener.(*Protocol))).ToNot(Succeed())
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:6128", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		for i := 0; i < 3; i++ {
+			serverConn, err := grpcListener.Accept()
+			Expect(err).To(BeNil())
+			Expect(serverConn.(*tls.Conn).ConnectionState().NegotiatedProtocol).To(Equal("h2"))
+			serverConn.Close()
+		}
+
+		_, err = h2Listener.Accept()
+		Expect(err).ToNot(BeNil())
+
+		proto, matched := listener.WouldMatch([]string{"h2"})
+		Expect(matched).To(BeTrue())
+		Expect(proto).To(Equal("h2"))
+	})
+
+	It("Should refuse to close a protocol to itself", func() {
+		protocol := newProtocol(listener, "h2", 1)
+		Expect(protocol.CloseTo(protocol)).ToNot(Succeed())
+		Expect(protocol.CloseTo(nil)).ToNot(Succeed())
+	})
+})
+
+var _ = Describe("Protocol middleware", func() {
+	It("Should pass connections through the listener's chain and then the protocol's", func() {
+		listener := &Listener{}
+		protocol := newProtocol(listener, "h2", 1)
+
+		var order []string
+		listener.Use(func(conn net.Conn) (net.Conn, error) {
+			order = append(order, "listener")
+			return conn, nil
+		})
+		protocol.Use(func(conn net.Conn) (net.Conn, error) {
+			order = append(order, "protocol 1")
+			return conn, nil
+		})
+		protocol.Use(func(conn net.Conn) (net.Conn, error) {
+			order = append(order, "protocol 2")
+			return NewPrefixConn(conn, nil), nil
+		})
+
+		conn, _ := net.Pipe()
+		protocol.senders.Add(1)
+		listener.deliverToProtocol("h2", protocol, conn, tls.ConnectionState{})
+
+		Expect(order).To(Equal([]string{"listener", "protocol 1", "protocol 2"}))
+		Expect(<-protocol.channel).To(Equal(NewPrefixConn(conn, nil)))
+	})
+
+	It("Should close connections a protocol's middleware returns an error for", func() {
+		listener := &Listener{}
+		protocol := newProtocol(listener, "h2", 1)
+
+		protocol.Use(func(conn net.Conn) (net.Conn, error) {
+			return nil, fmt.Errorf("dropped")
+		})
+
+		conn, peer := net.Pipe()
+		protocol.senders.Add(1)
+		listener.deliverToProtocol("h2", protocol, conn, tls.ConnectionState{})
+
+		Expect(len(protocol.channel)).To(Equal(0))
+		_, err := peer.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+	})
+})
+
+var _ = Describe("Protocol priority", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr:   "127.0.0.1:6143",
+		BufferSize: 2,
+		TLSConfig: &tls.Config{
+			NextProtos:   []string{"h2", "grpc"},
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	It("Should accept the connections of higher priority protocols first", func() {
+		_, err := listener.Protocol("h2")
+		Expect(err).To(BeNil())
+		_, err = listener.ProtocolWithPriority("grpc", 10)
+		Expect(err).To(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+
+		for _, protos := range [][]string{nil, {"h2"}, {"grpc"}} {
+			conn, err := tls.Dial("tcp", "127.0.0.1:6143", &tls.Config{InsecureSkipVerify: true, NextProtos: protos})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+		}
+
+		Eventually(listener.inFlight.Load).Should(Equal(int64(0)))
+
+		for _, proto := range []string{"grpc", "", "h2"} {
+			serverConn, err := listener.AcceptPriority()
+			Expect(err).To(BeNil())
+			Expect(serverConn.(*tls.Conn).ConnectionState().NegotiatedProtocol).To(Equal(proto))
+			serverConn.Close()
+		}
+
+		listener.Stop()
+		_, err = listener.AcceptPriority()
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("Shouldn't starve lower priority listeners", func() {
+		listener := &Listener{defaultChannel: make(chan net.Conn, 1)}
+		grpc := newProtocol(listener, "grpc", priorityStarvationLimit+2)
+		grpc.priority = 10
+		listener.channels = map[string]*Protocol{"grpc": grpc}
+
+		for i := 0; i < priorityStarvationLimit+2; i++ {
+			conn, _ := net.Pipe()
+			grpc.channel <- conn
+		}
+
+		lower, _ := net.Pipe()
+		listener.defaultChannel <- lower
+
+		for i := 0; i < priorityStarvationLimit; i++ {
+			conn, err := listener.AcceptPriority()
+			Expect(err).To(BeNil())
+			Expect(conn).ToNot(Equal(lower))
+		}
+
+		Expect(listener.AcceptPriority()).To(Equal(lower))
+
+		conn, err := listener.AcceptPriority()
+		Expect(err).To(BeNil())
+		Expect(conn).ToNot(Equal(lower))
+	})
+})
@@ -0,0 +1,77 @@
+package tlsprotocol
+
+import (
+	"net"
+	"time"
+)
+
+// RejectedConn is a connection the listener rejected,
+// handed to the consumer of Rejected() rather than
+// being closed
+type RejectedConn struct {
+	// Conn is the rejected connection, the consumer
+	// must close it. It's the TLS connection if it was
+	// rejected after the handshake, otherwise the raw
+	// connection, which for a failed handshake is left
+	// wherever the handshake stopped
+	Conn net.Conn
+
+	// Outcome is why the connection was rejected,
+	// ConnLimited, ConnHandshakeFailed or ConnRejected
+	Outcome ConnOutcome
+
+	// Err describes the rejection
+	Err error
+}
+
+// Rejected returns the channel receiving the connections
+// the listener rejects when RejectedBuffer is set, it is nil
+// otherwise. A new channel is created by each call to Start()
+// and it is closed when the listener stops, any connections
+// still in it are closed
+func (listener *Listener) Rejected() <-chan RejectedConn {
+	return listener.rejected
+}
+
+// reject hands the connection to the consumer of Rejected(),
+// closing it instead if RejectedBuffer isn't set or the
+// channel is full so a slow consumer never holds up the
+// listener
+func (listener *Listener) reject(conn net.Conn, tracked *Conn, outcome ConnOutcome, err error) {
+	if listener.rejected != nil {
+		if tracked != nil {
+			tracked.SetDeadline(time.Time{})
+			listener.untrackPending(tracked)
+		}
+
+		select {
+		case listener.rejected <- RejectedConn{Conn: conn, Outcome: outcome, Err: err}:
+			return
+		default:
+		}
+	}
+
+	conn.Close()
+}
+
+// closeRejected closes the channel returned by Rejected()
+// and the connections still in it, returning how many
+// connections were closed
+func (listener *Listener) closeRejected() int {
+	if listener.rejected == nil {
+		return 0
+	}
+
+	closed := 0
+	for {
+		select {
+		case rejected := <-listener.rejected:
+			rejected.Conn.Close()
+			closed++
+
+		default:
+			close(listener.rejected)
+			return closed
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package tlsprotocol
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ReloadCertOnSignal calls ReloadCertFromFiles with the
+// files every time the process receives one of the
+// signals, defaulting to SIGHUP if none are given, a
+// failed reload keeps the current certificate and its
+// error is reported by Errors(). The listener must be
+// started first, the returned function stops the reloading
+func (listener *Listener) ReloadCertOnSignal(certFile, keyFile string, signals ...os.Signal) (func(), error) {
+	if len(listener.workers) == 0 {
+		return nil, fmt.Errorf("listener must be started before reloading on signal")
+	}
+
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGHUP}
+	}
+
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-received:
+				if err := listener.ReloadCertFromFiles(certFile, keyFile); err != nil {
+					listener.reportError(fmt.Errorf("reload certificate: %w", err))
+				}
+
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(received)
+		close(stop)
+	}, nil
+}
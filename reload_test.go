@@ -0,0 +1,100 @@
+package tlsprotocol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"math/big"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// writeKeyPair writes a new self-signed key pair with
+// the serial number to PEM files in the directory
+func writeKeyPair(dir string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+
+	certFile, keyFile := filepath.Join(dir, "reload.crt"), filepath.Join(dir, "reload.key")
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+
+	return certFile, keyFile
+}
+
+var _ = Describe("Certificate reloading", func() {
+	cert, _ := tls.LoadX509KeyPair("test_certificate.crt", "test_certificate.key")
+	listener := &Listener{
+		BindAddr: "127.0.0.1:6120",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+
+	peerSerial := func() int64 {
+		conn, err := tls.Dial("tcp", "127.0.0.1:6120", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		serverConn, err := listener.Accept()
+		Expect(err).To(BeNil())
+		serverConn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	It("Should present the reloaded certificate to new handshakes", func() {
+		dir, err := os.MkdirTemp("", "tlsprotocol")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		certFile, keyFile := writeKeyPair(dir, 1001)
+		Expect(listener.ReloadCertFromFiles(certFile, keyFile)).To(Succeed())
+		Expect(peerSerial()).To(Equal(int64(1001)))
+
+		Expect(listener.ReloadCertFromFiles(filepath.Join(dir, "missing.crt"), keyFile)).ToNot(Succeed())
+		Expect(peerSerial()).To(Equal(int64(1001)))
+	})
+
+	It("Should reload the certificate on SIGHUP", func() {
+		dir, err := os.MkdirTemp("", "tlsprotocol")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		_, err = listener.ReloadCertOnSignal("", "")
+		Expect(err).ToNot(BeNil())
+
+		Expect(listener.Start()).To(BeNil())
+		defer listener.Stop()
+
+		certFile, keyFile := writeKeyPair(dir, 1002)
+		stop, err := listener.ReloadCertOnSignal(certFile, keyFile)
+		Expect(err).To(BeNil())
+		defer stop()
+
+		Expect(syscall.Kill(os.Getpid(), syscall.SIGHUP)).To(Succeed())
+		Eventually(peerSerial).Should(Equal(int64(1002)))
+	})
+})
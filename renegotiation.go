@@ -0,0 +1,97 @@
+package tlsprotocol
+
+import (
+	"encoding/binary"
+)
+
+// recordHeaderLen is the size of the header
+// that starts every TLS record
+const recordHeaderLen = 5
+
+// TLS record content types
+const (
+	recordChangeCipherSpec = 20
+	recordHandshake        = 22
+)
+
+// recordWatcher follows the TLS records read from a
+// connection by their headers, which are never encrypted,
+// to spot a client starting a new handshake once the first
+// has finished. It's fed every byte read in order from the
+// first so it never loses track of the record boundaries,
+// reads are only made by one go routine at a time so it
+// needs no locking
+type recordWatcher struct {
+	// header holds the bytes of a record
+	// header split across reads, remaining
+	// is the bytes left in the current record
+	header    [recordHeaderLen]byte
+	headerLen int
+	remaining int
+
+	// changedCipher is set by the client's
+	// ChangeCipherSpec, finished once the
+	// handshake record after it has been read
+	changedCipher bool
+	finished      bool
+
+	// renegotiated is called for the first handshake
+	// record read after the handshake finished
+	renegotiated func()
+	reported     bool
+}
+
+// observe follows the records in the bytes read
+func (watcher *recordWatcher) observe(b []byte) {
+	for len(b) > 0 && !watcher.reported {
+		if watcher.remaining > 0 {
+			skip := min(watcher.remaining, len(b))
+			watcher.remaining -= skip
+			b = b[skip:]
+			continue
+		}
+
+		copied := copy(watcher.header[watcher.headerLen:], b)
+		watcher.headerLen += copied
+		b = b[copied:]
+
+		if watcher.headerLen == recordHeaderLen {
+			watcher.headerLen = 0
+			watcher.remaining = int(binary.BigEndian.Uint16(watcher.header[3:]))
+			watcher.record(watcher.header[0])
+		}
+	}
+}
+
+// record steps through the client's side of the
+// handshake by the content type of each record, in
+// TLS 1.2 the client's Finished is the handshake record
+// after its ChangeCipherSpec and TLS 1.3 encrypts every
+// handshake record after it as application data
+func (watcher *recordWatcher) record(contentType byte) {
+	switch {
+	case contentType == recordChangeCipherSpec:
+		watcher.changedCipher = true
+
+	case contentType != recordHandshake || !watcher.changedCipher:
+
+	case !watcher.finished:
+		watcher.finished = true
+
+	default:
+		watcher.reported = true
+		watcher.renegotiated()
+	}
+}
+
+// watchRenegotiation has the connection's records followed
+// so OnRenegotiation is called and the attempt counted if
+// the client tries to renegotiate
+func (listener *Listener) watchRenegotiation(conn *Conn) {
+	conn.records = &recordWatcher{renegotiated: func() {
+		listener.stats.renegotiationAttempted()
+		if listener.OnRenegotiation != nil {
+			listener.OnRenegotiation(conn)
+		}
+	}}
+}
@@ -0,0 +1,84 @@
+package tlsprotocol
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// tlsRecordTypeHandshake is the content type
+// of the TLS record that carries a ClientHello,
+// it is always the first byte a TLS client sends
+const tlsRecordTypeHandshake = 0x16
+
+// PrefixConn is a net.Conn that replays bytes already
+// read from the underlying connection (i.e. while sniffing
+// the protocol) before continuing to read from it, so no
+// byte that was peeked is lost to whoever reads it next.
+// The plaintext listener delivers connections as a
+// PrefixConn and it can be used by middleware that sniff
+// the connections they are given
+type PrefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+// NewPrefixConn returns a connection that replays
+// `prefix` to its first reads before reading
+// from the underlying connection
+func NewPrefixConn(conn net.Conn, prefix []byte) *PrefixConn {
+	return &PrefixConn{Conn: conn, prefix: prefix}
+}
+
+// Read will drain the prefix before reading
+// from the underlying connection
+func (conn *PrefixConn) Read(b []byte) (int, error) {
+	if len(conn.prefix) > 0 {
+		n := copy(b, conn.prefix)
+		conn.prefix = conn.prefix[n:]
+		return n, nil
+	}
+
+	return conn.Conn.Read(b)
+}
+
+// NetConn returns the underlying connection
+func (conn *PrefixConn) NetConn() net.Conn {
+	return conn.Conn
+}
+
+// peekClientHello reads the first byte from the
+// connection to determine if the client is starting
+// a TLS handshake, the returned connection will replay
+// the peeked byte so no data is lost.
+//
+// If timeout is set and the client sends nothing
+// before it expires the connection is reported as
+// not being TLS, as the client is likely waiting
+// for the server to speak first. Once peeked the
+// read deadline is restored to `deadline`, which
+// also bounds the peek when timeout isn't set
+func peekClientHello(conn net.Conn, timeout time.Duration, deadline time.Time) (net.Conn, bool, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, false, err
+		}
+	}
+
+	buffer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buffer); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && timeout > 0 {
+			return conn, false, conn.SetReadDeadline(deadline)
+		}
+
+		return nil, false, err
+	}
+
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return NewPrefixConn(conn, buffer), buffer[0] == tlsRecordTypeHandshake, nil
+}
@@ -0,0 +1,126 @@
+package tlsprotocol
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// sampleFlushSize is how many bytes of records
+// a SampledConn buffers before writing them
+// to the listener's SampleWriter
+const sampleFlushSize = 32 * 1024
+
+// SampledConn is the connection delivered when the
+// listener's SampleConn chose to sample it, every read
+// and write is recorded to the listener's SampleWriter.
+//
+// Each record is a header line of the connection's ID,
+// "read" or "write" and the number of bytes followed by
+// the bytes themselves. Records are buffered and written
+// whole so those of different connections don't interleave,
+// the buffer is written once it fills up and when the
+// connection is closed
+type SampledConn struct {
+	net.Conn
+
+	id     uint64
+	sink   io.Writer
+	lock   *sync.Mutex
+	buffer bytes.Buffer
+
+	// bufferLock guards buffer
+	bufferLock sync.Mutex
+}
+
+// newSampledConn wraps the delivered connection so its
+// records are written to the sink, `lock` is shared by
+// every connection writing to the sink
+func newSampledConn(conn net.Conn, id uint64, sink io.Writer, lock *sync.Mutex) *SampledConn {
+	return &SampledConn{Conn: conn, id: id, sink: sink, lock: lock}
+}
+
+// Read reads from the connection
+// and records the bytes read
+func (conn *SampledConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.record("read", b[:n])
+	}
+
+	return n, err
+}
+
+// Write writes to the connection
+// and records the bytes written
+func (conn *SampledConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	if n > 0 {
+		conn.record("write", b[:n])
+	}
+
+	return n, err
+}
+
+// record buffers a record of the bytes, writing
+// the buffer to the sink once it's full
+func (conn *SampledConn) record(direction string, b []byte) {
+	conn.bufferLock.Lock()
+	defer conn.bufferLock.Unlock()
+
+	fmt.Fprintf(&conn.buffer, "%d %s %d\n", conn.id, direction, len(b))
+	conn.buffer.Write(b)
+
+	if conn.buffer.Len() >= sampleFlushSize {
+		conn.flush()
+	}
+}
+
+// flush writes the buffered records to the
+// sink, bufferLock must be held by the caller
+func (conn *SampledConn) flush() {
+	if conn.buffer.Len() == 0 {
+		return
+	}
+
+	conn.lock.Lock()
+	conn.sink.Write(conn.buffer.Bytes())
+	conn.lock.Unlock()
+
+	conn.buffer.Reset()
+}
+
+// Close closes the connection and then writes
+// any buffered records to the sink
+func (conn *SampledConn) Close() error {
+	err := conn.Conn.Close()
+
+	conn.bufferLock.Lock()
+	conn.flush()
+	conn.bufferLock.Unlock()
+
+	return err
+}
+
+// NetConn returns the sampled connection
+func (conn *SampledConn) NetConn() net.Conn {
+	return conn.Conn
+}
+
+// sampleConn wraps the connection in a SampledConn
+// if there is a SampleWriter and the listener's
+// SampleConn chooses to sample it
+func (listener *Listener) sampleConn(conn net.Conn, tracked *Conn) net.Conn {
+	if listener.SampleConn == nil || listener.SampleWriter == nil || !listener.SampleConn(conn) {
+		return conn
+	}
+
+	var id uint64
+	if tracked != nil {
+		id = tracked.ID()
+	}
+
+	return newSampledConn(conn, id, listener.SampleWriter, &listener.sampleLock)
+}
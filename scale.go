@@ -0,0 +1,121 @@
+package tlsprotocol
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SetListeners changes the number of sockets of a
+// started listener without closing the sockets that
+// remain. Growing binds new sockets to the SO_REUSEPORT
+// group, which accept straight away unless the listener
+// is paused. Shrinking removes the last sockets, which
+// stop accepting for the listener and hand the
+// connections queued in their backlog to the listener
+// before they are closed, it returns once they are.
+//
+// The kernel keeps queueing connections on a socket
+// until it's closed, any queued between the backlog
+// being drained and the close are reset. Linux 5.14+
+// migrates them to the remaining sockets instead if
+// the net.ipv4.tcp_migrate_req sysctl is enabled.
+//
+// Like Pause() and Resume() it mustn't be called
+// concurrently with the listener's other lifecycle
+// methods, it isn't supported with DualStack or a
+// ReuseportBPF program as both index the sockets
+func (listener *Listener) SetListeners(count int) error {
+	if len(listener.workers) == 0 {
+		return fmt.Errorf("listener must be started before setting its listeners")
+	}
+
+	if count < 1 {
+		return fmt.Errorf("listeners must be at least 1: %d", count)
+	}
+
+	if listener.wrapped != nil {
+		return fmt.Errorf("listeners can't be set for a wrapped listener")
+	}
+
+	if listener.dualSockAddr != nil {
+		return fmt.Errorf("listeners can't be set for a dual stack listener")
+	}
+
+	if len(listener.ReuseportBPF) > 0 {
+		return fmt.Errorf("listeners can't be set with a reuseport BPF program")
+	}
+
+	if count > len(listener.workers) {
+		return listener.addWorkers(count)
+	}
+
+	listener.removeWorkers(count)
+	return nil
+}
+
+// addWorkers binds the sockets of the workers added to
+// reach `count` and starts them if the listener is
+// accepting, if any socket fails to bind those already
+// bound are closed and the workers are left unchanged
+func (listener *Listener) addWorkers(count int) error {
+	running := false
+	for i := range listener.workers {
+		if listener.workers[i].isRunning() {
+			running = true
+			break
+		}
+	}
+
+	workers := make([]*worker, len(listener.workers), count)
+	copy(workers, listener.workers)
+
+	next := listener.workers[len(listener.workers)-1].index + 1
+	for len(workers) < count {
+		index := next + len(workers) - len(listener.workers)
+		socket, err := listener.buildSocket(index)
+		if err != nil {
+			for i := len(listener.workers); i < len(workers); i++ {
+				workers[i].socket.Close()
+			}
+
+			return fmt.Errorf("builder worker %d socket: %w", index, err)
+		}
+
+		workers = append(workers, &worker{
+			parent: listener,
+			index:  index,
+			socket: socket,
+		})
+	}
+
+	if running {
+		for i := len(listener.workers); i < len(workers); i++ {
+			workers[i].start()
+		}
+	}
+
+	listener.workers = workers
+	listener.Listeners = count
+	return nil
+}
+
+// removeWorkers drains and closes the sockets of
+// the workers after the first `count`, waiting
+// for every removed socket to be closed
+func (listener *Listener) removeWorkers(count int) {
+	removed := listener.workers[count:]
+	listener.workers = append([]*worker(nil), listener.workers[:count]...)
+	listener.Listeners = count
+
+	var drained sync.WaitGroup
+	for i := range removed {
+		drained.Add(1)
+		listener.workerGroup.Add(1)
+		go func(worker *worker) {
+			defer drained.Done()
+			worker.drain()
+		}(removed[i])
+	}
+
+	drained.Wait()
+}
@@ -0,0 +1,74 @@
+package tlsprotocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// defaultListener is a net.Listener over the default
+// channel of a Listener, closing it only stops its own
+// Accept() and leaves the Listener running
+type defaultListener struct {
+	parent *Listener
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ServeDefault serves the connections delivered to the
+// default listener (i.e. everything that didn't negotiate
+// an ALPN Protocol with its own listener) with the HTTP
+// server until the server or the listener is closed.
+//
+// Closing the server with Close() or Shutdown() doesn't stop
+// the listener and both ways of closing have ServeDefault
+// return http.ErrServerClosed
+func (listener *Listener) ServeDefault(srv *http.Server) error {
+	if listener.defaultChannel == nil {
+		return fmt.Errorf("listener must be started before serving")
+	}
+
+	err := srv.Serve(&defaultListener{parent: listener, closed: make(chan struct{})})
+	if errors.Is(err, net.ErrClosed) {
+		return http.ErrServerClosed
+	}
+
+	return err
+}
+
+// Accept will block until a connection is delivered
+// to the default channel, it fails with net.ErrClosed
+// once either listener is closed
+func (listener *defaultListener) Accept() (net.Conn, error) {
+	select {
+	case conn, ok := <-listener.parent.defaultChannel:
+		if ok {
+			return conn, nil
+		}
+
+	case err := <-listener.parent.fatal:
+		return nil, err
+
+	case <-listener.closed:
+	}
+
+	return nil, &net.OpError{Op: "accept", Net: listener.Addr().Network(), Addr: listener.Addr(), Err: net.ErrClosed}
+}
+
+// Close stops Accept() without closing the parent
+func (listener *defaultListener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+	})
+
+	return nil
+}
+
+// Addr returns the address that the
+// parent listener is receiving connections on
+func (listener *defaultListener) Addr() net.Addr {
+	return listener.parent.Addr()
+}
@@ -0,0 +1,266 @@
+package tlsprotocol
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// gracefulStopInterval is how often GracefulStop()
+// checks if the listener has finished draining
+const gracefulStopInterval = 10 * time.Millisecond
+
+// defaultDrainHookTimeout is how long stopping waits
+// for the DrainHook if DrainHookTimeout isn't set
+const defaultDrainHookTimeout = time.Second
+
+// lifetimeConnsGrace is how long a listener that
+// reached MaxLifetimeConns waits for its queued
+// connections to be accepted before stopping
+const lifetimeConnsGrace = 5 * time.Second
+
+// GracefulStop stops the workers accepting new connections
+// and then waits up to `timeout` for in-flight handshakes to
+// complete and for queued connections to be accepted, before
+// stopping the listener and force closing any connection that
+// remains. It returns the number of connections force closed
+func (listener *Listener) GracefulStop(timeout time.Duration) int {
+	listener.stopWorkers()
+	listener.waitDrained(timeout)
+	return listener.stop()
+}
+
+// LifetimeConnsReached reports if the listener
+// has delivered MaxLifetimeConns connections
+// since it was started, and so has stopped or
+// is stopping on its own
+func (listener *Listener) LifetimeConnsReached() bool {
+	return listener.lifetimeReached.Load()
+}
+
+// stopAfterLifetimeConns gracefully stops the listener
+// once it has delivered MaxLifetimeConns connections,
+// unless it's already been stopped
+func (listener *Listener) stopAfterLifetimeConns() {
+	listener.stopLock.Lock()
+	select {
+	case <-listener.done:
+		listener.stopLock.Unlock()
+		return
+	default:
+	}
+
+	listener.stopWorkers()
+	listener.stopLock.Unlock()
+
+	listener.waitDrained(lifetimeConnsGrace)
+	listener.stop()
+}
+
+// waitDrained waits up to `timeout` for the
+// in-flight handshakes to complete and for the
+// queued connections to be accepted
+func (listener *Listener) waitDrained(timeout time.Duration) {
+	clock := listener.getClock()
+	deadline := clock.Now().Add(timeout)
+	for !listener.drained() && clock.Now().Before(deadline) {
+		<-clock.After(gracefulStopInterval)
+	}
+}
+
+// drained reports if there are no connections
+// in-flight or waiting in any of the channels
+func (listener *Listener) drained() bool {
+	if listener.inFlight.Load() > 0 || len(listener.defaultChannel) > 0 {
+		return false
+	}
+
+	for _, protocol := range listener.protocols() {
+		if len(protocol.channel) > 0 || protocol.consumersBacklog() > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// protocols returns every Protocol listener
+// attached to the listener, including the
+// plaintext and drain listeners
+func (listener *Listener) protocols() []*Protocol {
+	listener.channelsLock.RLock()
+	defer listener.channelsLock.RUnlock()
+
+	protocols := make([]*Protocol, 0, len(listener.channels)+2)
+	for _, protocol := range listener.channels {
+		protocols = append(protocols, protocol)
+	}
+
+	if listener.plaintext != nil {
+		protocols = append(protocols, listener.plaintext)
+	}
+
+	if listener.drain != nil {
+		protocols = append(protocols, listener.drain)
+	}
+
+	return protocols
+}
+
+// stopWorkers stops every worker so no new
+// connections are accepted, with SyncHandshake
+// a worker's listen go routine can still be
+// handling its last connection afterwards
+func (listener *Listener) stopWorkers() {
+	for i := range listener.workers {
+		if listener.workers[i] != nil {
+			listener.workers[i].stop()
+		}
+	}
+}
+
+// stop tears down the listener, connections still
+// being handshaked, waiting to be delivered or queued
+// in a channel are closed and counted
+func (listener *Listener) stop() int {
+	listener.stopLock.Lock()
+	defer listener.stopLock.Unlock()
+
+	select {
+	case <-listener.done:
+		return 0
+	default:
+	}
+
+	listener.stopWorkers()
+
+	close(listener.stopping)
+	closed := listener.closePending()
+	listener.workerGroup.Wait()
+	listener.handshakes.Wait()
+
+	var queued []net.Conn
+	for _, protocol := range listener.protocols() {
+		queued = append(queued, takeQueued(protocol.channel)...)
+		protocol.Close()
+		queued = append(queued, protocol.takeConsumersQueued()...)
+	}
+
+	closed += int(listener.forceClosed.Swap(0))
+
+	queued = append(queued, takeQueued(listener.defaultChannel)...)
+	close(listener.defaultChannel)
+	closed += listener.closeQueued(queued)
+	closed += listener.closeRejected()
+
+	if listener.accessLog != nil {
+		listener.accessLog.close()
+	}
+
+	listener.closeEvents()
+
+	listener.stateLock.Lock()
+	listener.draining = false
+	listener.stateLock.Unlock()
+
+	listener.channelsLock.Lock()
+	listener.channels = nil
+	listener.redirects = nil
+	listener.channelsLock.Unlock()
+
+	listener.workers = nil
+	listener.sockAddr = nil
+	listener.dualSockAddr = nil
+
+	close(listener.done)
+	return closed
+}
+
+// closePending closes the connections that haven't
+// been routed to a channel yet and stops any more
+// connections from being tracked
+func (listener *Listener) closePending() int {
+	listener.pendingLock.Lock()
+	listener.pendingClosed = true
+
+	pending := make([]*Conn, 0, len(listener.pending))
+	for conn := range listener.pending {
+		pending = append(pending, conn)
+	}
+	listener.pendingLock.Unlock()
+
+	for i := range pending {
+		pending[i].Close()
+	}
+
+	return len(pending)
+}
+
+// takeQueued removes the connections
+// waiting in the channel to be accepted
+func takeQueued(channel chan net.Conn) []net.Conn {
+	var queued []net.Conn
+	for {
+		select {
+		case conn, open := <-channel:
+			if !open {
+				return queued
+			}
+
+			queued = append(queued, conn)
+
+		default:
+			return queued
+		}
+	}
+}
+
+// closeQueued closes the connections taken from
+// the channels, giving the DrainHook a chance to
+// write to them first
+func (listener *Listener) closeQueued(queued []net.Conn) int {
+	if listener.DrainHook != nil && len(queued) > 0 {
+		listener.runDrainHook(queued)
+	}
+
+	for i := range queued {
+		queued[i].Close()
+	}
+
+	return len(queued)
+}
+
+// runDrainHook calls the DrainHook for every connection
+// and waits for them to return, up to DrainHookTimeout
+func (listener *Listener) runDrainHook(queued []net.Conn) {
+	timeout := listener.DrainHookTimeout
+	if timeout <= 0 {
+		timeout = defaultDrainHookTimeout
+	}
+
+	// the deadline is from the wall clock as the
+	// runtime compares socket deadlines against it
+	deadline := time.Now().Add(timeout)
+
+	var hooks sync.WaitGroup
+	for i := range queued {
+		queued[i].SetDeadline(deadline)
+
+		hooks.Add(1)
+		go func(conn net.Conn) {
+			defer hooks.Done()
+			listener.DrainHook(conn)
+		}(queued[i])
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		hooks.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-listener.getClock().After(timeout):
+	}
+}
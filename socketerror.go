@@ -0,0 +1,40 @@
+package tlsprotocol
+
+import (
+	"fmt"
+)
+
+// SocketError is returned by Start() when a system
+// call building a worker socket fails, so callers
+// can tell which call failed and inspect the errno
+// (i.e. errors.Is(err, syscall.EADDRINUSE))
+type SocketError struct {
+	// Op is the failing operation, one of "socket",
+	// "setsockopt", "getsockopt", "setnonblock",
+	// "bind", "listen" or "getsockname"
+	Op string
+
+	// Option is the socket option being set
+	// or read when Op is "setsockopt" or
+	// "getsockopt", otherwise it's empty
+	Option string
+
+	// Err is the error returned by the
+	// system call, usually a syscall.Errno
+	Err error
+}
+
+// Error returns the operation, option
+// and the system call's error
+func (err *SocketError) Error() string {
+	if err.Option != "" {
+		return fmt.Sprintf("%s %s: %s", err.Op, err.Option, err.Err)
+	}
+
+	return fmt.Sprintf("%s: %s", err.Op, err.Err)
+}
+
+// Unwrap returns the system call's error
+func (err *SocketError) Unwrap() error {
+	return err.Err
+}
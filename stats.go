@@ -0,0 +1,339 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// HandshakeDurationBuckets are the upper bounds of
+// the buckets of Stats.HandshakeDurations, the final
+// bucket counts handshakes that took longer
+var HandshakeDurationBuckets = [...]time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// Stats is a point in time snapshot of the
+// counters maintained by a Listener
+type Stats struct {
+	// Versions is the number of completed
+	// handshakes keyed by the negotiated
+	// TLS version (i.e. tls.VersionTLS12)
+	Versions map[uint16]uint64
+
+	// CipherSuites is the number of completed
+	// handshakes keyed by the negotiated
+	// cipher suite (i.e. tls.TLS_AES_128_GCM_SHA256)
+	CipherSuites map[uint16]uint64
+
+	// HandshakeDurations is a histogram of how long
+	// completed handshakes took, each bucket counts
+	// handshakes that took less than the bound of the
+	// same index in HandshakeDurationBuckets and that
+	// weren't counted by an earlier bucket
+	HandshakeDurations [len(HandshakeDurationBuckets) + 1]uint64
+
+	// HandshakeDurationTotal is the sum of how
+	// long the completed handshakes took
+	HandshakeDurationTotal time.Duration
+
+	// Protocols is the number of completed handshakes
+	// keyed by the negotiated ALPN Protocol, handshakes
+	// that didn't negotiate one are keyed by ""
+	Protocols map[string]uint64
+
+	// HandshakeErrors is the number of
+	// accepted connections whose handshake
+	// failed (i.e. timed out or was invalid)
+	HandshakeErrors uint64
+
+	// Labels is the number of completed handshakes
+	// keyed by the label the listener's Labeler gave
+	// the connection, unlabelled connections aren't
+	// counted
+	Labels map[string]uint64
+
+	// Queues is the occupancy of the channel of each
+	// listener connections are delivered to, keyed by
+	// the ALPN Protocol or "default", "plaintext" and
+	// "drain" for the listeners of the same name
+	Queues map[string]QueueStats
+
+	// Renegotiations is the number of delivered
+	// connections whose client tried to renegotiate
+	Renegotiations uint64
+
+	// AcceptQueueOverflows is the number of connections
+	// the kernel dropped since the listener started as an
+	// accept queue was full (i.e. a SYN flood or workers
+	// not accepting fast enough), a sign more Listeners
+	// are needed. It's only supported on Linux and counts
+	// the overflows of every socket in the network
+	// namespace, not just the listener's
+	AcceptQueueOverflows uint64
+
+	// HandshakesShed is the number of connections closed
+	// without a handshake as MaxHandshakesPerSecond
+	// was exceeded
+	HandshakesShed uint64
+
+	// ConnsDropped is the number of connections closed
+	// after their handshake as the channel they were
+	// being delivered to was full, see OverflowPolicy
+	ConnsDropped uint64
+
+	// PendingHandshakes is the number of accepted
+	// connections that haven't completed the handshake
+	// yet, it's a gauge rather than a counter so it
+	// isn't zeroed by ResetStats()
+	PendingHandshakes int64
+
+	// HandshakeRate is the number of handshakes started
+	// in the last whole second, shed connections aren't
+	// counted. Like PendingHandshakes it's a gauge
+	HandshakeRate float64
+}
+
+// QueueStats is the occupancy of a
+// channel connections are queued in
+type QueueStats struct {
+	// Depth is the number of connections
+	// waiting in the channel to be accepted
+	Depth int
+
+	// HighWater is the most connections the
+	// channel has held after a connection was
+	// queued, a high-water mark close to the
+	// channel's size suggests a slow consumer
+	// or a backlog that is too small
+	HighWater int
+}
+
+// stats holds the live counters for a
+// listener, guarded by a lock as they are
+// updated from every connection goroutine
+type stats struct {
+	lock         sync.Mutex
+	versions     map[uint16]uint64
+	cipherSuites map[uint16]uint64
+	durations    [len(HandshakeDurationBuckets) + 1]uint64
+	durationSum  time.Duration
+	protocols    map[string]uint64
+	labels       map[string]uint64
+	highWater    map[string]int
+
+	renegotiations  uint64
+	shed            uint64
+	dropped         uint64
+	handshakeErrors uint64
+
+	// rateWindow is the start of the second
+	// rateCount counts the handshakes started
+	// in, lastRateCount is the count of the
+	// second before it
+	rateWindow    time.Time
+	rateCount     uint64
+	lastRateCount uint64
+}
+
+// handshakeCompleted records the negotiated
+// parameters and the duration of a successful
+// handshake
+func (stats *stats) handshakeCompleted(state tls.ConnectionState, duration time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	if stats.versions == nil {
+		stats.versions = make(map[uint16]uint64)
+		stats.cipherSuites = make(map[uint16]uint64)
+		stats.protocols = make(map[string]uint64)
+	}
+
+	stats.versions[state.Version]++
+	stats.cipherSuites[state.CipherSuite]++
+	stats.protocols[state.NegotiatedProtocol]++
+	stats.durationSum += duration
+
+	bucket := len(HandshakeDurationBuckets)
+	for i := range HandshakeDurationBuckets {
+		if duration < HandshakeDurationBuckets[i] {
+			bucket = i
+			break
+		}
+	}
+
+	stats.durations[bucket]++
+}
+
+// connectionLabelled records the label
+// of a successful handshake
+func (stats *stats) connectionLabelled(label string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	if stats.labels == nil {
+		stats.labels = make(map[string]uint64)
+	}
+
+	stats.labels[label]++
+}
+
+// connectionQueued raises the high-water mark of the
+// named listener's channel if depth is above it
+func (stats *stats) connectionQueued(name string, depth int) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	if stats.highWater == nil {
+		stats.highWater = make(map[string]int)
+	}
+
+	if depth > stats.highWater[name] {
+		stats.highWater[name] = depth
+	}
+}
+
+// renegotiationAttempted counts a client
+// trying to renegotiate its connection
+func (stats *stats) renegotiationAttempted() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.renegotiations++
+}
+
+// handshakeFailed counts an accepted
+// connection whose handshake failed
+func (stats *stats) handshakeFailed() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.handshakeErrors++
+}
+
+// handshakeShed counts a connection closed
+// as the handshake rate limit was exceeded
+func (stats *stats) handshakeShed() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.shed++
+}
+
+// connectionDropped counts a connection closed
+// as the channel it was delivered to was full
+func (stats *stats) connectionDropped() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.dropped++
+}
+
+// handshakeStarted counts a handshake
+// started at `now` towards the rate
+func (stats *stats) handshakeStarted(now time.Time) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.rollRate(now)
+	stats.rateCount++
+}
+
+// handshakeRate returns the number of handshakes
+// started in the last whole second before `now`
+func (stats *stats) handshakeRate(now time.Time) float64 {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.rollRate(now)
+	return float64(stats.lastRateCount)
+}
+
+// rollRate moves the rate window on to the second
+// `now` is in, lock must be held by the caller
+func (stats *stats) rollRate(now time.Time) {
+	elapsed := now.Sub(stats.rateWindow)
+	switch {
+	case stats.rateWindow.IsZero():
+		stats.rateWindow = now
+
+	case elapsed >= 2*time.Second:
+		stats.rateWindow = now
+		stats.rateCount = 0
+		stats.lastRateCount = 0
+
+	case elapsed >= time.Second:
+		stats.rateWindow = stats.rateWindow.Add(time.Second)
+		stats.lastRateCount = stats.rateCount
+		stats.rateCount = 0
+	}
+}
+
+// snapshot copies the live counters into
+// a Stats struct that is safe to hand out
+func (stats *stats) snapshot() Stats {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.copy()
+}
+
+// reset zeroes the live counters and returns a
+// snapshot of them from before they were zeroed
+func (stats *stats) reset() Stats {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	snapshot := stats.copy()
+	stats.versions = nil
+	stats.cipherSuites = nil
+	stats.protocols = nil
+	stats.labels = nil
+	stats.highWater = nil
+	stats.renegotiations = 0
+	stats.shed = 0
+	stats.dropped = 0
+	stats.handshakeErrors = 0
+	stats.durationSum = 0
+	stats.durations = [len(HandshakeDurationBuckets) + 1]uint64{}
+
+	return snapshot
+}
+
+// copy copies the live counters into a
+// Stats struct, lock must be held by the caller
+func (stats *stats) copy() Stats {
+	snapshot := Stats{
+		Versions:               make(map[uint16]uint64, len(stats.versions)),
+		CipherSuites:           make(map[uint16]uint64, len(stats.cipherSuites)),
+		HandshakeDurations:     stats.durations,
+		HandshakeDurationTotal: stats.durationSum,
+		Protocols:              make(map[string]uint64, len(stats.protocols)),
+		HandshakeErrors:        stats.handshakeErrors,
+		Renegotiations:         stats.renegotiations,
+		HandshakesShed:         stats.shed,
+		ConnsDropped:           stats.dropped,
+		Labels:                 make(map[string]uint64, len(stats.labels)),
+		Queues:                 make(map[string]QueueStats, len(stats.highWater)),
+	}
+
+	for version, count := range stats.versions {
+		snapshot.Versions[version] = count
+	}
+
+	for cipherSuite, count := range stats.cipherSuites {
+		snapshot.CipherSuites[cipherSuite] = count
+	}
+
+	for proto, count := range stats.protocols {
+		snapshot.Protocols[proto] = count
+	}
+
+	for label, count := range stats.labels {
+		snapshot.Labels[label] = count
+	}
+
+	for name, highWater := range stats.highWater {
+		snapshot.Queues[name] = QueueStats{HighWater: highWater}
+	}
+
+	return snapshot
+}
@@ -1,59 +1,355 @@
 package tlsprotocol
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"syscall"
+	"time"
 )
 
+// respawnAttempts is the number of times
+// RespawnWorkers tries to rebuild the socket of
+// an exited worker before giving up on it
+const respawnAttempts = 5
+
+// respawnBackoff is how long RespawnWorkers waits
+// before the first attempt to rebuild the socket
+// of an exited worker, it doubles every attempt
+const respawnBackoff = 100 * time.Millisecond
+
+// workerDrainIdle is how long a worker removed by
+// SetListeners waits for another connection in its
+// socket's backlog before the backlog is treated as
+// drained and the socket is closed
+const workerDrainIdle = 10 * time.Millisecond
+
+// workerDrainTimeout is the longest a worker removed
+// by SetListeners drains its socket's backlog, under
+// constant load the kernel keeps queueing connections
+// on the socket until it's closed
+const workerDrainTimeout = time.Second
+
+// defaultCanAcceptInterval is how often CanAccept
+// is polled while it returns false if the listener's
+// CanAcceptInterval isn't set
+const defaultCanAcceptInterval = 100 * time.Millisecond
+
 // worker is a standalone socket that
 // listens for connections and then sends
 // those connections back to the parent
 // listener for handling
 type worker struct {
 	parent  *Listener
+	index   int
 	running bool
 	socket  net.Listener
 	lock    sync.Mutex
+
+	// paused is set while the socket has a deadline
+	// in the past, generation counts the calls of
+	// start() so a listen go routine woken by a pause
+	// knows a newer one has taken over after a resume
+	paused     bool
+	generation uint64
+
+	// exitErr is the error that stopped the
+	// worker accepting connections while the
+	// listener was running, it can't be resumed
+	// unless its socket is respawned
+	exitErr error
+
+	// stopped is set once the listener has
+	// stopped the worker so it isn't respawned
+	stopped bool
+}
+
+// deadlineSocket is implemented by the
+// sockets of the workers (i.e. *net.TCPListener)
+type deadlineSocket interface {
+	SetDeadline(t time.Time) error
 }
 
 // start sets the internal state of
 // the worker to running and spawns
-// a go routine for receiving connections
+// the go routines for receiving connections
 // from the configured socket
 func (worker *worker) start() {
-	if worker.isRunning() {
+	worker.lock.Lock()
+	defer worker.lock.Unlock()
+
+	if worker.running || worker.exitErr != nil {
 		return
 	}
 
+	worker.run()
+}
+
+// run sets the worker running and spawns
+// its listen go routines, lock must be
+// held by the caller
+func (worker *worker) run() {
+	if worker.paused {
+		worker.socket.(deadlineSocket).SetDeadline(time.Time{})
+		worker.paused = false
+	}
+
+	worker.running = true
+	worker.generation++
+
+	for i := 0; i < worker.parent.AcceptGoroutines; i++ {
+		worker.parent.workerGroup.Add(1)
+		go worker.listen(worker.generation, worker.socket)
+	}
+}
+
+// pause stops the worker accepting connections
+// without closing its socket, the accept loop is
+// woken by moving the socket's deadline into the
+// past and start() resumes the worker
+func (worker *worker) pause() error {
 	worker.lock.Lock()
 	defer worker.lock.Unlock()
-	worker.running = true
 
-	go worker.listen()
+	socket, ok := worker.socket.(deadlineSocket)
+	if !ok {
+		return fmt.Errorf("worker socket can't be paused: %T", worker.socket)
+	}
+
+	if !worker.running {
+		return nil
+	}
+
+	worker.running = false
+	worker.paused = true
+	return socket.SetDeadline(time.Unix(1, 0))
+}
+
+// isCurrent will return if the worker is
+// running and `generation` is its latest
+// listen go routine
+func (worker *worker) isCurrent(generation uint64) bool {
+	worker.lock.Lock()
+	defer worker.lock.Unlock()
+	return worker.running && worker.generation == generation
+}
+
+// listen will receive connections from
+// the socket of the worker, which is passed
+// in as it's replaced when the worker is
+// respawned, until the internal state of
+// the worker is changed to no running
+func (worker *worker) listen(generation uint64, socket net.Listener) {
+	defer worker.parent.workerGroup.Done()
+
+	for worker.isCurrent(generation) {
+		if !worker.waitForCapacity(generation) {
+			return
+		}
+
+		conn, err := socket.Accept()
+		if err != nil {
+			if !worker.isCurrent(generation) {
+				return
+			}
+
+			if isPermanentAcceptError(err) {
+				worker.exit(generation, err)
+				return
+			}
+
+			worker.parent.reportError(err)
+			continue
+		}
+
+		if worker.parent.wrapped != nil {
+			conn = unwrapAccepted(conn)
+		}
+
+		worker.received(conn)
+	}
+}
+
+// received hands a connection accepted by the worker
+// to the listener, it's closed instead if it would
+// exceed the listener's MaxPendingHandshakes
+func (worker *worker) received(conn net.Conn) {
+	if !worker.parent.connectionAccepted() {
+		conn.Close()
+		return
+	}
+
+	if worker.parent.SyncHandshake {
+		worker.parent.connectionReceived(conn, worker.index)
+	} else {
+		go worker.parent.connectionReceived(conn, worker.index)
+	}
+}
+
+// waitForCapacity polls the listener's CanAccept until
+// it returns true, it returns false if the listener
+// starts stopping or `generation` is no longer the
+// worker's latest listen go routine while waiting
+func (worker *worker) waitForCapacity(generation uint64) bool {
+	canAccept := worker.parent.CanAccept
+	if canAccept == nil {
+		return true
+	}
+
+	interval := worker.parent.CanAcceptInterval
+	if interval <= 0 {
+		interval = defaultCanAcceptInterval
+	}
+
+	clock := worker.parent.getClock()
+	for !canAccept() {
+		select {
+		case <-worker.parent.stopping:
+			return false
+		case <-clock.After(interval):
+		}
+
+		if !worker.isCurrent(generation) {
+			return false
+		}
+	}
+
+	return true
 }
 
-// isRunning will return the value of
-// `running` of the worker but in a race
-// safe way
+// exit marks the worker as no longer running after
+// its socket failed, only the first of the worker's
+// listen go routines to fail reports the fatal error
+// and calls OnWorkerExit
+func (worker *worker) exit(generation uint64, err error) {
+	worker.lock.Lock()
+	if !worker.running || worker.generation != generation {
+		worker.lock.Unlock()
+		return
+	}
+
+	worker.running = false
+	worker.exitErr = err
+	worker.lock.Unlock()
+
+	worker.parent.reportFatal(err)
+	if worker.parent.OnWorkerExit != nil {
+		worker.parent.OnWorkerExit(worker.index, err)
+	}
+
+	if worker.parent.RespawnWorkers && worker.parent.wrapped == nil {
+		worker.parent.workerGroup.Add(1)
+		go worker.respawn()
+	}
+}
+
+// respawn rebuilds the socket of an exited worker
+// and starts it again, backing off between attempts
+// and giving up after respawnAttempts or once the
+// listener starts stopping
+func (worker *worker) respawn() {
+	defer worker.parent.workerGroup.Done()
+
+	clock := worker.parent.getClock()
+	backoff := respawnBackoff
+	for attempt := 1; attempt <= respawnAttempts; attempt++ {
+		select {
+		case <-worker.parent.stopping:
+			return
+		case <-clock.After(backoff):
+		}
+
+		backoff *= 2
+
+		socket, err := worker.parent.buildSocket(worker.index)
+		if err != nil {
+			worker.parent.reportError(fmt.Errorf("respawn worker %d (attempt %d): %w", worker.index, attempt, err))
+			continue
+		}
+
+		worker.lock.Lock()
+		if worker.stopped {
+			worker.lock.Unlock()
+			socket.Close()
+			return
+		}
+
+		worker.socket = socket
+		worker.exitErr = nil
+		worker.paused = false
+		worker.run()
+		worker.lock.Unlock()
+		return
+	}
+
+	worker.parent.reportFatal(fmt.Errorf("worker %d not respawned after %d attempts", worker.index, respawnAttempts))
+}
+
+// isPermanentAcceptError reports if an error from
+// accepting means the socket will never accept
+// another connection, rather than a failure of
+// a single connection (i.e. ECONNABORTED, EMFILE)
+func isPermanentAcceptError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.EBADF) ||
+		errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTSOCK)
+}
+
+// isRunning will return if the
+// worker is accepting connections
 func (worker *worker) isRunning() bool {
 	worker.lock.Lock()
 	defer worker.lock.Unlock()
 	return worker.running
 }
 
-// listen will receive connections from
-// the configured socket for the worker
-// until the internal state of the worker
-// is changed to no running
-func (worker *worker) listen() {
-	for worker.isRunning() {
-		conn, err := worker.socket.Accept()
+// drain stops the worker like stop() but hands the
+// connections queued in its socket's backlog to the
+// listener before closing the socket, it accepts until
+// the backlog stays empty for workerDrainIdle, giving up
+// after workerDrainTimeout or once the listener stops
+func (worker *worker) drain() {
+	defer worker.parent.workerGroup.Done()
+
+	worker.lock.Lock()
+	worker.running = false
+	worker.paused = false
+	worker.stopped = true
+	socket := worker.socket
+	worker.lock.Unlock()
+
+	defer socket.Close()
+
+	// the deadline also wakes the listen go
+	// routines blocked accepting so they exit
+	deadline, ok := socket.(deadlineSocket)
+	if !ok {
+		return
+	}
+
+	giveUp := time.Now().Add(workerDrainTimeout)
+	for time.Now().Before(giveUp) {
+		select {
+		case <-worker.parent.stopping:
+			return
+		default:
+		}
+
+		if err := deadline.SetDeadline(time.Now().Add(workerDrainIdle)); err != nil {
+			return
+		}
+
+		conn, err := socket.Accept()
 		if err != nil {
-			worker.parent.errors <- err
+			if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || isPermanentAcceptError(err) {
+				return
+			}
+
+			worker.parent.reportError(err)
 			continue
 		}
 
-		go worker.parent.connectionReceived(conn)
+		worker.received(conn)
 	}
 }
 
@@ -65,5 +361,6 @@ func (worker *worker) stop() {
 	defer worker.lock.Unlock()
 
 	worker.running = false
+	worker.stopped = true
 	worker.socket.Close()
 }
@@ -0,0 +1,56 @@
+package tlsprotocol
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// Wrap returns a Listener that routes the connections
+// accepted from `l` rather than binding its own sockets,
+// so the ALPN demultiplexing can be used with listeners
+// created elsewhere (i.e. test pipes or other transports).
+//
+// The handshake is performed with `cfg`, if `l` returns
+// TLS connections (i.e. from tls.NewListener) that haven't
+// completed their handshake they are unwrapped so the
+// listener can route them. The BindAddr and the socket
+// options (i.e. SendBuffer, FirewallMark) are ignored and
+// `l` is closed when the listener stops, so it can't be
+// started again
+func Wrap(l net.Listener, cfg *tls.Config) *Listener {
+	return &Listener{
+		TLSConfig: cfg,
+		Listeners: 1,
+		wrapped:   l,
+	}
+}
+
+// startWrapped sets up the single worker
+// accepting from the listener given to Wrap()
+func (listener *Listener) startWrapped() error {
+	if len(listener.workers) != 1 {
+		listener.abortStart()
+		return fmt.Errorf("a wrapped listener only supports a single listener: %d", len(listener.workers))
+	}
+
+	listener.addr = listener.wrapped.Addr()
+	listener.workers[0] = &worker{
+		parent: listener,
+		index:  0,
+		socket: listener.wrapped,
+	}
+
+	return nil
+}
+
+// unwrapAccepted returns the connection underneath
+// a TLS connection accepted from a wrapped listener so
+// the listener can perform the handshake itself
+func unwrapAccepted(conn net.Conn) net.Conn {
+	if tlsConn, ok := conn.(*tls.Conn); ok && !tlsConn.ConnectionState().HandshakeComplete {
+		return tlsConn.NetConn()
+	}
+
+	return conn
+}